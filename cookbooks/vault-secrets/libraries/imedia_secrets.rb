@@ -2,6 +2,10 @@ require 'net/http'
 require 'uri'
 require 'json'
 require 'openssl'
+require 'base64'
+require 'digest'
+require 'securerandom'
+require 'time'
 
 class VaultError < StandardError
 end
@@ -9,22 +13,44 @@ end
 class Chef
   # Class for get secrets via vault-auth
   class VaultSecrets
+    LOGIN_PATH = '/v1/auth/chef/login/signed'.freeze
+
     def initialize
       chef_server_uri = URI.parse(Chef::Config[:chef_server_url])
       @vault_server = chef_server_uri.host
       @vault_port = 8200
       client_name = Chef::Config[:node_name]
-      cert = ::File.read('/etc/chef/client.pem')
-      auth = { 'key' => cert, 'client' => client_name }
+      key = OpenSSL::PKey::RSA.new(::File.read('/etc/chef/client.pem'))
+      auth = signed_auth(client_name, key)
       @client = Net::HTTP.new(@vault_server, @vault_port)
       @client.verify_mode = OpenSSL::SSL::VERIFY_NONE
       @client.use_ssl = true
       @token = get_token(auth)
     end
 
+    # Signs the login request the same way Chef signs API requests, so the
+    # client key never leaves the node.
+    def signed_auth(client_name, key)
+      timestamp = Time.now.utc.iso8601
+      auth = { 'client' => client_name, 'timestamp' => timestamp, 'nonce' => SecureRandom.hex(16) }
+      content = auth.sort.map { |k, v| "#{k}=#{v}" }.join('&')
+      canonical = [
+        'Method:POST',
+        "Hashed Path:#{hash_str(LOGIN_PATH)}",
+        "X-Ops-Content-Hash:#{hash_str(content)}",
+        "X-Ops-Timestamp:#{timestamp}",
+        "X-Ops-UserId:#{client_name}"
+      ].join("\n")
+      auth.merge('signature' => Base64.strict_encode64(key.private_encrypt(canonical)))
+    end
+
+    def hash_str(str)
+      Base64.strict_encode64(Digest::SHA1.digest(str))
+    end
+
     # rubocop:disable Metrics/AbcSize
     def get_token(auth)
-      req = Net::HTTP::Post.new('/v1/auth/chef/login/key')
+      req = Net::HTTP::Post.new(LOGIN_PATH)
       req.body = auth.to_json
       resp = @client.request(req)
       res = JSON.parse(resp.body)
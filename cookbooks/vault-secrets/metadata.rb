@@ -4,7 +4,7 @@ maintainer_email 'root.vagner@gmail.com'
 license 'All Rights Reserved'
 description 'Installs/Configures vault-secrets'
 long_description 'Installs/Configures vault-secrets'
-version '0.0.2'
+version '0.0.3'
 chef_version '>= 12.1' if respond_to?(:chef_version)
 
 issues_url       'https://github.com/svagner/vault-auth-chef/issues'
@@ -0,0 +1,180 @@
+package chefclient
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/pkg/errors"
+)
+
+const (
+	// pendingPrefix is the storage prefix of clients awaiting approval.
+	pendingPrefix = "pending/"
+	// approvedPrefix is the storage prefix of approved clients.
+	approvedPrefix = "approved/"
+)
+
+// clientNameRe matches the client names the pending paths accept. Logins
+// refuse other names, which could resolve to another client in the Chef API
+// paths while being stored under their own name.
+var clientNameRe = regexp.MustCompile(`^\w(([\w-.]+)?\w)?$`)
+
+// pendingEntry is a client which logged in while not approved yet.
+type pendingEntry struct {
+	Environment string    `json:"environment"`
+	Roles       []string  `json:"roles"`
+	RemoteAddr  string    `json:"remote_addr"`
+	FirstSeen   time.Time `json:"first_seen"`
+	LastSeen    time.Time `json:"last_seen"`
+	Rejected    bool      `json:"rejected"`
+}
+
+// approvedEntry is a client promoted to the full mapping evaluation.
+type approvedEntry struct {
+	ApprovedAt time.Time `json:"approved_at"`
+}
+
+// Pending returns the pending entry of the client, or nil if it has none.
+func (b *backend) Pending(ctx context.Context, s logical.Storage, client string) (*pendingEntry, error) {
+	entry, err := s.Get(ctx, pendingPrefix+client)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get pending client from storage")
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var result pendingEntry
+	if err := entry.DecodeJSON(&result); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode pending client")
+	}
+	return &result, nil
+}
+
+// checkApproval reports whether the client was approved. Logins of clients
+// which were not are recorded as pending, and refused once rejected.
+func (b *backend) checkApproval(ctx context.Context, req *logical.Request, config *config, client string, node *chefNode, roles []string) (bool, error) {
+	if !config.ApprovalRequired {
+		return true, nil
+	}
+
+	b.approvalLock.Lock()
+	defer b.approvalLock.Unlock()
+
+	approved, err := req.Storage.Get(ctx, approvedPrefix+client)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to get approved client from storage")
+	}
+	if approved != nil {
+		return true, nil
+	}
+
+	pending, err := b.Pending(ctx, req.Storage, client)
+	if err != nil {
+		return false, err
+	}
+	if pending != nil && pending.Rejected {
+		return false, logical.CodedError(403, "client was rejected")
+	}
+
+	// Enabling approval does not cut off the clients holding a token issued
+	// before, they are approved on renewal. Pending clients logged in since,
+	// their bootstrap tokens are not. Renewals do not carry the client
+	// address, only logins are recorded.
+	if req.Operation == logical.RenewOperation {
+		if pending == nil && req.Auth != nil && req.Auth.IssueTime.Before(config.ApprovalRequiredSince) {
+			if err := b.approve(ctx, req.Storage, client); err != nil {
+				return false, err
+			}
+			b.logger.Info(fmt.Sprintf("Client %s approved, its token was issued before approval was required", client))
+			return true, nil
+		}
+		return false, nil
+	}
+
+	now := time.Now().UTC()
+	if pending == nil {
+		pending = &pendingEntry{FirstSeen: now}
+		b.logger.Info(fmt.Sprintf("Client %s is pending approval", client))
+	}
+	pending.Environment = node.Environment
+	pending.Roles = roles
+	pending.LastSeen = now
+	if addr := remoteAddr(config, req); addr != nil {
+		pending.RemoteAddr = addr.String()
+	}
+
+	entry, err := logical.StorageEntryJSON(pendingPrefix+client, pending)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to generate storage entry")
+	}
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return false, errors.Wrapf(err, "failed to write pending client to storage")
+	}
+	return false, nil
+}
+
+// approve promotes the client to the full mapping evaluation and removes it
+// from the pending queue. The caller must hold the approval lock.
+func (b *backend) approve(ctx context.Context, s logical.Storage, client string) error {
+	entry, err := logical.StorageEntryJSON(approvedPrefix+client, &approvedEntry{
+		ApprovedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to generate storage entry")
+	}
+	if err := s.Put(ctx, entry); err != nil {
+		return errors.Wrapf(err, "failed to write approved client to storage")
+	}
+	if err := s.Delete(ctx, pendingPrefix+client); err != nil {
+		return errors.Wrapf(err, "failed to delete pending client")
+	}
+	return nil
+}
+
+// approvalRequiredSince returns when approval was first enabled for a
+// configuration being written: now when it is enabled for the first time,
+// unchanged afterwards, even across a disable, so that enabling it again does
+// not approve the tokens issued meanwhile. Configurations enabling approval
+// before it was recorded keep the zero time, which approves no renewal.
+func (b *backend) approvalRequiredSince(ctx context.Context, s logical.Storage, approvalRequired bool) (time.Time, error) {
+	entry, err := s.Get(ctx, "config")
+	if err != nil {
+		return time.Time{}, errors.Wrapf(err, "failed to get config from storage")
+	}
+	if entry != nil {
+		var prev config
+		if err := entry.DecodeJSON(&prev); err != nil {
+			return time.Time{}, errors.Wrapf(err, "failed to decode configuration")
+		}
+		if prev.ApprovalRequired || !prev.ApprovalRequiredSince.IsZero() {
+			return prev.ApprovalRequiredSince, nil
+		}
+	}
+	if !approvalRequired {
+		return time.Time{}, nil
+	}
+	return time.Now().UTC(), nil
+}
+
+// pendingCreds returns the bootstrap credentials of a client awaiting
+// approval: the bootstrap and anyone policies with the mount token settings,
+// without identity groups.
+func (b *backend) pendingCreds(config *config, node *chefNode) (*verifyResp, error) {
+	if len(config.BootstrapPolicies) == 0 {
+		return nil, logical.CodedError(403, "client is pending approval")
+	}
+
+	policies := newStringSet(config.BootstrapPolicies...)
+	policies.add(config.AnyonePolicies...)
+
+	creds := newCreds(config, node, policies.list())
+	creds.pending = true
+	if err := b.sanitizeCreds(creds); err != nil {
+		return nil, err
+	}
+	return creds, nil
+}
@@ -0,0 +1,196 @@
+package chefclient
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	log "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestApprovalRequiredSince(t *testing.T) {
+	ctx := context.Background()
+	s := &logical.InmemStorage{}
+	b := &backend{}
+
+	writeConfig := func(c *config) {
+		entry, err := logical.StorageEntryJSON("config", c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Put(ctx, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Disabled
+	since, err := b.approvalRequiredSince(ctx, s, false)
+	if err != nil || !since.IsZero() {
+		t.Fatalf("expected zero time, got %s, %v", since, err)
+	}
+
+	// Enabled on a new mount
+	before := time.Now().UTC()
+	since, err = b.approvalRequiredSince(ctx, s, true)
+	if err != nil || since.Before(before) {
+		t.Fatalf("expected now, got %s, %v", since, err)
+	}
+
+	// Enabled on a mount in use
+	writeConfig(&config{})
+	since, err = b.approvalRequiredSince(ctx, s, true)
+	if err != nil || since.Before(before) {
+		t.Fatalf("expected now, got %s, %v", since, err)
+	}
+
+	// Staying enabled keeps the time
+	enabled := time.Date(2009, 1, 1, 12, 0, 0, 0, time.UTC)
+	writeConfig(&config{ApprovalRequired: true, ApprovalRequiredSince: enabled})
+	since, err = b.approvalRequiredSince(ctx, s, true)
+	if err != nil || !since.Equal(enabled) {
+		t.Fatalf("expected %s, got %s, %v", enabled, since, err)
+	}
+
+	// Disabling keeps the time
+	since, err = b.approvalRequiredSince(ctx, s, false)
+	if err != nil || !since.Equal(enabled) {
+		t.Fatalf("expected %s, got %s, %v", enabled, since, err)
+	}
+
+	// Enabling again keeps the first time, the tokens issued while it was
+	// disabled are not approved on renewal
+	writeConfig(&config{ApprovalRequiredSince: enabled})
+	since, err = b.approvalRequiredSince(ctx, s, true)
+	if err != nil || !since.Equal(enabled) {
+		t.Fatalf("expected %s, got %s, %v", enabled, since, err)
+	}
+
+	// Enabled before the time was recorded
+	writeConfig(&config{ApprovalRequired: true})
+	since, err = b.approvalRequiredSince(ctx, s, true)
+	if err != nil || !since.IsZero() {
+		t.Fatalf("expected zero time, got %s, %v", since, err)
+	}
+}
+
+// TestApprovalToggle writes configurations disabling and enabling approval
+// again, and renews a token issued while approval was disabled.
+func TestApprovalToggle(t *testing.T) {
+	ctx := context.Background()
+	s := &logical.InmemStorage{}
+	b := Backend(&logical.BackendConfig{Logger: log.NewNullLogger()})
+
+	writeConfig := func(approvalRequired bool) *config {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "config",
+			Storage:   s,
+			Data: map[string]interface{}{
+				"chef_server":       "https://chef.example.com/organizations/example/",
+				"run_list_src":      "node",
+				"approval_required": approvalRequired,
+			},
+		})
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("failed to write config: %v %#v", err, resp)
+		}
+		config, err := b.Config(ctx, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return config
+	}
+
+	first := writeConfig(true).ApprovalRequiredSince
+	if first.IsZero() {
+		t.Fatal("expected the time approval was enabled")
+	}
+	if since := writeConfig(false).ApprovalRequiredSince; !since.Equal(first) {
+		t.Fatalf("expected %s after disabling, got %s", first, since)
+	}
+	issued := time.Now().UTC()
+	config := writeConfig(true)
+	if !config.ApprovalRequiredSince.Equal(first) {
+		t.Fatalf("expected %s after enabling again, got %s", first, config.ApprovalRequiredSince)
+	}
+
+	req := &logical.Request{
+		Operation: logical.RenewOperation,
+		Storage:   s,
+		Auth:      &logical.Auth{IssueTime: issued},
+	}
+	approved, err := b.checkApproval(ctx, req, config, "web-01", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if approved {
+		t.Fatal("expected a token issued while approval was disabled not to be approved")
+	}
+}
+
+func TestCheckApprovalRenew(t *testing.T) {
+	enabled := time.Date(2009, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		name     string
+		since    time.Time
+		issued   time.Time
+		pending  bool
+		rejected bool
+		approved bool
+	}{
+		{"issued before approval was required", enabled, enabled.Add(-time.Hour), false, false, true},
+		{"issued after approval was required", enabled, enabled.Add(time.Hour), false, false, false},
+		{"approval enabled before it was recorded", time.Time{}, enabled.Add(-time.Hour), false, false, false},
+		{"pending", enabled, enabled.Add(-time.Hour), true, false, false},
+		{"rejected", enabled, enabled.Add(-time.Hour), true, true, false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			s := &logical.InmemStorage{}
+			b := &backend{logger: log.NewNullLogger()}
+
+			if tc.pending {
+				entry, err := logical.StorageEntryJSON(pendingPrefix+"web-01", &pendingEntry{Rejected: tc.rejected})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := s.Put(ctx, entry); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			config := &config{ApprovalRequired: true, ApprovalRequiredSince: tc.since}
+			req := &logical.Request{
+				Operation: logical.RenewOperation,
+				Storage:   s,
+				Auth:      &logical.Auth{IssueTime: tc.issued},
+			}
+			approved, err := b.checkApproval(ctx, req, config, "web-01", nil, nil)
+			if tc.rejected {
+				if err == nil {
+					t.Fatal("expected a rejected client to be refused")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if approved != tc.approved {
+				t.Fatalf("expected approved %t, got %t", tc.approved, approved)
+			}
+
+			// Approved renewals approve the client for its next logins
+			entry, err := s.Get(ctx, approvedPrefix+"web-01")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (entry != nil) != tc.approved {
+				t.Fatalf("expected stored approval %t", tc.approved)
+			}
+		})
+	}
+}
@@ -1,12 +1,13 @@
 package chefclient
 
 import (
-	log "github.com/mgutz/logxi/v1"
+	log "github.com/hashicorp/go-hclog"
 
 	"context"
+	"sync"
 
-	"github.com/hashicorp/vault/logical"
-	"github.com/hashicorp/vault/logical/framework"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
 	"github.com/pkg/errors"
 )
 
@@ -24,8 +25,29 @@ type backend struct {
 	*framework.Backend
 	logger log.Logger
 
-	RolesMap *framework.PolicyMap
-	HostsMap *framework.PolicyMap
+	RolesMap        *framework.PolicyMap
+	HostsMap        *framework.PolicyMap
+	EnvironmentsMap *framework.PolicyMap
+	PolicyNamesMap  *framework.PolicyMap
+	PolicyGroupsMap *framework.PolicyMap
+	RecipesMap      *framework.PolicyMap
+	TagsMap         *framework.PolicyMap
+
+	// configLock serializes configuration updates.
+	configLock sync.Mutex
+
+	// signatureLock serializes the replay check of signed logins.
+	signatureLock sync.Mutex
+
+	// identityLock serializes the machine identity bindings.
+	identityLock sync.Mutex
+
+	// approvalLock serializes the updates of the pending queue.
+	approvalLock sync.Mutex
+
+	// searchCache holds the results of search mappings by query.
+	searchCache map[string]*searchResult
+	searchLock  sync.Mutex
 }
 
 // Backend creates a new backend, mapping the proper paths, help information,
@@ -34,6 +56,7 @@ func Backend(c *logical.BackendConfig) *backend {
 	var b backend
 
 	b.logger = c.Logger
+	b.searchCache = make(map[string]*searchResult)
 
 	// RolesMap maps chef roles (run_list) to a series of policies.
 	b.RolesMap = &framework.PolicyMap{
@@ -51,11 +74,54 @@ func Backend(c *logical.BackendConfig) *backend {
 		PolicyKey: "policy",
 	}
 
+	// EnvironmentsMap maps a chef environment to a series of policies.
+	b.EnvironmentsMap = &framework.PolicyMap{
+		PathMap: framework.PathMap{
+			Name: "environments",
+		},
+		PolicyKey: "policy",
+	}
+
+	// PolicyNamesMap maps a Policyfile policy name to a series of policies.
+	b.PolicyNamesMap = &framework.PolicyMap{
+		PathMap: framework.PathMap{
+			Name: "policy_names",
+		},
+		PolicyKey: "policy",
+	}
+
+	// PolicyGroupsMap maps a Policyfile policy group to a series of policies.
+	b.PolicyGroupsMap = &framework.PolicyMap{
+		PathMap: framework.PathMap{
+			Name: "policy_groups",
+		},
+		PolicyKey: "policy",
+	}
+
+	// RecipesMap maps a run_list recipe, or any recipe of a cookbook, to a
+	// series of policies.
+	b.RecipesMap = &framework.PolicyMap{
+		PathMap: framework.PathMap{
+			Name: "recipes",
+		},
+		PolicyKey: "policy",
+	}
+
+	// TagsMap maps a chef node tag to a series of policies.
+	b.TagsMap = &framework.PolicyMap{
+		PathMap: framework.PathMap{
+			Name: "tags",
+		},
+		PolicyKey: "policy",
+	}
+
 	b.Backend = &framework.Backend{
 		BackendType: logical.TypeCredential,
 
 		AuthRenew: b.pathAuthRenew,
 
+		PeriodicFunc: b.periodicFunc,
+
 		Help: backendHelp,
 
 		PathsSpecial: &logical.Paths{
@@ -81,10 +147,435 @@ get help.
 			})
 
 			// auth/chef/map/roles/*
-			paths = append(paths, b.RolesMap.Paths()...)
+			paths = append(paths, policyMapPaths(b.RolesMap, `[-\w]+`)...)
 
 			// auth/chef/map/hosts/*
-			paths = append(paths, b.HostsMap.Paths()...)
+			paths = append(paths, policyMapPaths(b.HostsMap, `[-\w]+`)...)
+
+			// auth/chef/map/environments/*
+			paths = append(paths, policyMapPaths(b.EnvironmentsMap, `[-\w]+`)...)
+
+			// auth/chef/map/policy_names/*
+			paths = append(paths, policyMapPaths(b.PolicyNamesMap, `[-\w]+`)...)
+
+			// auth/chef/map/policy_groups/*
+			paths = append(paths, policyMapPaths(b.PolicyGroupsMap, `[-\w]+`)...)
+
+			// auth/chef/map/recipes/*
+			paths = append(paths, policyMapPaths(b.RecipesMap, `[-\w.]+(?:::[-\w.]+)?`)...)
+
+			// auth/chef/map/tags/*
+			paths = append(paths, policyMapPaths(b.TagsMap, `[-\w.:]+`)...)
+
+			// auth/chef/map/rules
+			paths = append(paths, &framework.Path{
+				Pattern:      "map/rules/?$",
+				HelpSynopsis: "List the attribute rules",
+				Callbacks: map[logical.Operation]framework.OperationFunc{
+					logical.ListOperation: b.pathRulesList,
+					logical.ReadOperation: b.pathRulesList,
+				},
+			})
+
+			// auth/chef/map/rules/:name
+			paths = append(paths, &framework.Path{
+				Pattern:      "map/rules/" + framework.GenericNameRegex("name"),
+				HelpSynopsis: "Map nodes matching an attribute expression to policies",
+				HelpDescription: `
+
+Read, write or delete an attribute rule. Nodes whose attributes match the
+expression are granted the rule's policies, on top of the other mappings.
+Attributes are addressed with dotted paths into the node object. For example:
+
+    $ vault write auth/chef/map/rules/rhel-db \
+        policy=db-{{env}} \
+		match='automatic.platform_family == "rhel" and normal.app.tier in ["db", "cache"]'
+
+Expressions support ==, !=, <, <=, >, >=, =~ (regular expression), in [...],
+and, or, not and parentheses. Numbers and versions such as
+automatic.chef_packages.chef.version are compared numerically.
+
+`,
+				Fields: withTokenSettings(map[string]*framework.FieldSchema{
+					"name": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Name of the rule.",
+					},
+
+					"policy": &framework.FieldSchema{
+						Type:        framework.TypeCommaStringSlice,
+						Description: "Comma-separated list of policies granted by the rule.",
+					},
+
+					"match": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Expression over the node attributes the node must match.",
+					},
+				}),
+				Callbacks: map[logical.Operation]framework.OperationFunc{
+					logical.UpdateOperation: b.pathRulesWrite,
+					logical.ReadOperation:   b.pathRulesRead,
+					logical.DeleteOperation: b.pathRulesDelete,
+				},
+			})
+
+			// auth/chef/map/searches
+			paths = append(paths, &framework.Path{
+				Pattern:      "map/searches/?$",
+				HelpSynopsis: "List the search mappings",
+				Callbacks: map[logical.Operation]framework.OperationFunc{
+					logical.ListOperation: b.pathSearchesList,
+					logical.ReadOperation: b.pathSearchesList,
+				},
+			})
+
+			// auth/chef/map/searches/:name
+			paths = append(paths, &framework.Path{
+				Pattern:      "map/searches/" + framework.GenericNameRegex("name"),
+				HelpSynopsis: "Map nodes returned by a Chef search to policies",
+				HelpDescription: `
+
+Read, write or delete a search mapping. Nodes returned by the search query on
+the node index are granted the mapping's policies, on top of the other
+mappings. Results are cached for the configured search_refresh. For example:
+
+    $ vault write auth/chef/map/searches/nginx-prod \
+        policy=nginx-{{env}} \
+		query='chef_environment:prod AND recipes:nginx*'
+
+`,
+				Fields: withTokenSettings(map[string]*framework.FieldSchema{
+					"name": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Name of the search mapping.",
+					},
+
+					"policy": &framework.FieldSchema{
+						Type:        framework.TypeCommaStringSlice,
+						Description: "Comma-separated list of policies granted by the search.",
+					},
+
+					"query": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Chef search query on the node index.",
+					},
+				}),
+				Callbacks: map[logical.Operation]framework.OperationFunc{
+					logical.UpdateOperation: b.pathSearchesWrite,
+					logical.ReadOperation:   b.pathSearchesRead,
+					logical.DeleteOperation: b.pathSearchesDelete,
+				},
+			})
+
+			// auth/chef/deny/:kind
+			denyKindPattern := "(?P<kind>hosts|roles|environments)"
+			paths = append(paths, &framework.Path{
+				Pattern:      "deny/" + denyKindPattern + "/?$",
+				HelpSynopsis: "List the deny entries of hosts, roles or environments",
+				Fields: map[string]*framework.FieldSchema{
+					"kind": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Deny list: hosts, roles or environments.",
+					},
+				},
+				Callbacks: map[logical.Operation]framework.OperationFunc{
+					logical.ListOperation: b.pathDenyList,
+					logical.ReadOperation: b.pathDenyList,
+				},
+			})
+
+			// auth/chef/deny/:kind/:pattern
+			paths = append(paths, &framework.Path{
+				Pattern:      "deny/" + denyKindPattern + `/(?P<pattern>[-\w.*]+)`,
+				HelpSynopsis: "Refuse the hosts, roles or environments matching a glob pattern",
+				HelpDescription: `
+
+Read, write or delete a deny entry. A client is refused at login and renewal,
+whatever the other mappings grant, when its client or node name, one of its
+expanded roles or its environment matches the pattern. For example:
+
+    $ vault write auth/chef/deny/roles/web reason="incident 42" ttl=24h
+    $ vault write 'auth/chef/deny/hosts/db-*' reason="compromised"
+
+`,
+				Fields: map[string]*framework.FieldSchema{
+					"kind": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Deny list: hosts, roles or environments.",
+					},
+
+					"pattern": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Glob pattern of the names refused.",
+					},
+
+					"reason": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Reason logged when a client is refused.",
+					},
+
+					"ttl": &framework.FieldSchema{
+						Type:        framework.TypeDurationSecond,
+						Description: "Duration after which the entry expires. Never if 0.",
+					},
+				},
+				Callbacks: map[logical.Operation]framework.OperationFunc{
+					logical.UpdateOperation: b.pathDenyWrite,
+					logical.ReadOperation:   b.pathDenyRead,
+					logical.DeleteOperation: b.pathDenyDelete,
+				},
+			})
+
+			// auth/chef/identities
+			paths = append(paths, &framework.Path{
+				Pattern:      "identities/?$",
+				HelpSynopsis: "List the clients bound to a machine identity",
+				Callbacks: map[logical.Operation]framework.OperationFunc{
+					logical.ListOperation: b.pathIdentitiesList,
+					logical.ReadOperation: b.pathIdentitiesList,
+				},
+			})
+
+			// auth/chef/identities/:client
+			paths = append(paths, &framework.Path{
+				Pattern:      "identities/" + framework.GenericNameRegex("client"),
+				HelpSynopsis: "Read or reset the machine identity binding of a client",
+				HelpDescription: `
+
+With machine_identity enabled, a client is bound to the fingerprint of its
+machine on its first login: node attributes with machine_identity_source=node,
+the machine_id login field with machine_identity_source=login. Read the binding, or delete it when the host was
+legitimately rebuilt so that the client is bound again on its next login:
+
+    $ vault delete auth/chef/identities/web-01
+
+`,
+				Fields: map[string]*framework.FieldSchema{
+					"client": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Name of the Chef client.",
+					},
+				},
+				Callbacks: map[logical.Operation]framework.OperationFunc{
+					logical.ReadOperation:   b.pathIdentitiesRead,
+					logical.DeleteOperation: b.pathIdentitiesDelete,
+				},
+			})
+
+			// auth/chef/pending
+			paths = append(paths, &framework.Path{
+				Pattern:      "pending/?$",
+				HelpSynopsis: "List the clients pending approval",
+				Callbacks: map[logical.Operation]framework.OperationFunc{
+					logical.ListOperation: b.pathPendingList,
+					logical.ReadOperation: b.pathPendingList,
+				},
+			})
+
+			// auth/chef/pending/:client
+			paths = append(paths, &framework.Path{
+				Pattern:      "pending/" + framework.GenericNameRegex("client"),
+				HelpSynopsis: "Read or delete a client pending approval",
+				HelpDescription: `
+
+With approval_required enabled, clients which were not approved are recorded
+with their environment, roles and address when they log in. A deleted entry is
+recorded again on the next login of the client.
+
+`,
+				Fields: map[string]*framework.FieldSchema{
+					"client": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Name of the Chef client.",
+					},
+				},
+				Callbacks: map[logical.Operation]framework.OperationFunc{
+					logical.ReadOperation:   b.pathPendingRead,
+					logical.DeleteOperation: b.pathPendingDelete,
+				},
+			})
+
+			// auth/chef/pending/:client/approve
+			paths = append(paths, &framework.Path{
+				Pattern:      "pending/" + framework.GenericNameRegex("client") + "/approve",
+				HelpSynopsis: "Approve a client",
+				HelpDescription: `
+
+Promotes the client to the full mapping evaluation. Clients can be approved
+before their first login. The client must log in again to get its policies.
+
+`,
+				Fields: map[string]*framework.FieldSchema{
+					"client": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Name of the Chef client.",
+					},
+				},
+				Callbacks: map[logical.Operation]framework.OperationFunc{
+					logical.UpdateOperation: b.pathPendingApprove,
+				},
+			})
+
+			// auth/chef/approved
+			paths = append(paths, &framework.Path{
+				Pattern:      "approved/?$",
+				HelpSynopsis: "List or approve clients in bulk",
+				HelpDescription: `
+
+Lists the approved clients, or approves a list of clients. With chef_clients,
+every client registered on the Chef server but the rejected ones is approved,
+which seeds the approvals before approval_required is enabled on a mount in
+use:
+
+    $ vault write auth/chef/approved clients=web-01,web-02
+    $ vault write auth/chef/approved chef_clients=true
+
+`,
+				Fields: map[string]*framework.FieldSchema{
+					"clients": &framework.FieldSchema{
+						Type:        framework.TypeCommaStringSlice,
+						Description: "Comma-separated list of the clients to approve.",
+					},
+
+					"chef_clients": &framework.FieldSchema{
+						Type:        framework.TypeBool,
+						Description: "Approve every client registered on the Chef server, using the service credential.",
+					},
+				},
+				Callbacks: map[logical.Operation]framework.OperationFunc{
+					logical.ListOperation:   b.pathApprovedList,
+					logical.ReadOperation:   b.pathApprovedList,
+					logical.UpdateOperation: b.pathApprovedWrite,
+				},
+			})
+
+			// auth/chef/pending/:client/reject
+			paths = append(paths, &framework.Path{
+				Pattern:      "pending/" + framework.GenericNameRegex("client") + "/reject",
+				HelpSynopsis: "Reject a client",
+				HelpDescription: `
+
+Refuses the logins and renewals of the client until it is approved again or
+its pending entry is deleted. Rejecting an approved client withdraws its
+approval.
+
+`,
+				Fields: map[string]*framework.FieldSchema{
+					"client": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Name of the Chef client.",
+					},
+				},
+				Callbacks: map[logical.Operation]framework.OperationFunc{
+					logical.UpdateOperation: b.pathPendingReject,
+				},
+			})
+
+			// auth/chef/role
+			paths = append(paths, &framework.Path{
+				Pattern:      "role/?$",
+				HelpSynopsis: "List the login roles",
+				Callbacks: map[logical.Operation]framework.OperationFunc{
+					logical.ListOperation: b.pathRoleList,
+				},
+			})
+
+			// auth/chef/role/:name
+			paths = append(paths, &framework.Path{
+				Pattern:      "role/" + framework.GenericNameRegex("name"),
+				HelpSynopsis: "Manage login roles with bound constraints",
+				HelpDescription: `
+
+Read, write or delete a login role. A client logging in with a role must meet
+every bound constraint of the role and is granted the role's policies instead
+of the mount wide mappings. For example:
+
+    $ vault write auth/chef/role/web \
+        bound_chef_roles=web \
+		bound_environments=prod \
+		bound_client_names="web-*" \
+		policies=web-{{env}} \
+		ttl=1h
+
+`,
+				Fields: map[string]*framework.FieldSchema{
+					"name": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Name of the role.",
+					},
+
+					"bound_chef_roles": &framework.FieldSchema{
+						Type: framework.TypeCommaStringSlice,
+						Description: "Comma-separated list of Chef roles. The node " +
+							"must have at least one of them in its run_list.",
+					},
+
+					"bound_environments": &framework.FieldSchema{
+						Type:        framework.TypeCommaStringSlice,
+						Description: "Comma-separated list of Chef environments the node must be in.",
+					},
+
+					"bound_client_names": &framework.FieldSchema{
+						Type:        framework.TypeCommaStringSlice,
+						Description: "Comma-separated list of client name glob patterns.",
+					},
+
+					"bound_policy_groups": &framework.FieldSchema{
+						Type:        framework.TypeCommaStringSlice,
+						Description: "Comma-separated list of Policyfile policy groups the node must be in.",
+					},
+
+					"policies": &framework.FieldSchema{
+						Type:        framework.TypeCommaStringSlice,
+						Description: "Comma-separated list of policies granted by the role.",
+					},
+
+					"ttl": &framework.FieldSchema{
+						Type:        framework.TypeDurationSecond,
+						Description: "Duration after which authentication will expire.",
+					},
+
+					"max_ttl": &framework.FieldSchema{
+						Type:        framework.TypeDurationSecond,
+						Description: "Maximum duration after which authentication will expire.",
+					},
+
+					"period": &framework.FieldSchema{
+						Type:        framework.TypeDurationSecond,
+						Description: "If set, tokens are periodic and renewable for this period forever.",
+					},
+
+					"explicit_max_ttl": &framework.FieldSchema{
+						Type:        framework.TypeDurationSecond,
+						Description: "Hard limit of the token lifetime, renewals included.",
+					},
+
+					"num_uses": &framework.FieldSchema{
+						Type:        framework.TypeInt,
+						Description: "Number of times the token can be used, unlimited if 0.",
+					},
+
+					"bound_cidrs": &framework.FieldSchema{
+						Type:        framework.TypeCommaStringSlice,
+						Description: "Comma-separated list of CIDR blocks logins and tokens are allowed from.",
+					},
+
+					"token_type": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Type of the tokens, 'service', 'batch' or 'default'.",
+					},
+
+					"no_default_policy": &framework.FieldSchema{
+						Type:        framework.TypeBool,
+						Description: "Leave the 'default' policy out of the tokens.",
+					},
+				},
+				Callbacks: map[logical.Operation]framework.OperationFunc{
+					logical.UpdateOperation: b.pathRoleWrite,
+					logical.ReadOperation:   b.pathRoleRead,
+					logical.DeleteOperation: b.pathRoleDelete,
+				},
+			})
 
 			// auth/chef/config
 			paths = append(paths, &framework.Path{
@@ -100,7 +591,9 @@ address, data bags path, TLS validation, default policy and TTLs. For example:
 		skip_tls=false \
 		data_bags=hosts \
 		run_list_src=data \
-		anyone_policies=chef
+		anyone_policies=chef \
+		service_client=vault \
+		service_key=@vault.pem
 
 For more information and examples, please see the online documentation.
 
@@ -130,8 +623,103 @@ For more information and examples, please see the online documentation.
 					},
 
 					"run_list_src": &framework.FieldSchema{
+						Type: framework.TypeString,
+						Description: "Describes where to look for information about client roles. " +
+							"Comma-separated list of 'node' and 'data', in order.",
+					},
+
+					"run_list_merge": &framework.FieldSchema{
+						Type:    framework.TypeString,
+						Default: runListMergeUnion,
+						Description: "How the run lists of several sources are merged: " +
+							"'union', 'first_non_empty' or 'override'.",
+					},
+
+					"data_bag_item": &framework.FieldSchema{
+						Type:    framework.TypeString,
+						Default: defaultDataBagItem,
+						Description: "Template of the client's data bag item name, e.g. " +
+							"'{{short_name}}' or '{{client | replace \".\" \"_\"}}'.",
+					},
+
+					"data_bag_run_list_path": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Default:     defaultDataBagRunListPath,
+						Description: "Path of the run_list in the data bag item.",
+					},
+
+					"data_bag_environment_path": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Default:     defaultDataBagEnvironmentPath,
+						Description: "Path of the environment in the data bag item.",
+					},
+
+					"data_bag_name_path": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Default:     defaultDataBagNamePath,
+						Description: "Path of the node display name in the data bag item.",
+					},
+
+					"data_bag_fields": &framework.FieldSchema{
+						Type: framework.TypeKVPairs,
+						Description: "Extra name=path pairs read from the data bag item " +
+							"as policy templates and token metadata.",
+					},
+
+					"data_bag_secret": &framework.FieldSchema{
+						Type: framework.TypeString,
+						Description: "Shared secret of encrypted data bags. It is never " +
+							"returned when reading the configuration.",
+					},
+
+					"run_list_expansion": &framework.FieldSchema{
+						Type:    framework.TypeString,
+						Default: "none",
+						Description: "How nested roles are expanded: 'none', 'server' " +
+							"through the Chef roles API or 'ohai' from the attributes reported by " +
+							"the node, which trusts the node.",
+					},
+
+					"declared_policies": &framework.FieldSchema{
+						Type: framework.TypeBool,
+						Description: "Grant the policies declared in the attributes of the " +
+							"node's roles and environment.",
+					},
+
+					"declared_policy_attribute": &framework.FieldSchema{
+						Type:    framework.TypeString,
+						Default: "vault.policies",
+						Description: "Path of the role and environment attribute " +
+							"declaring policies, under default_attributes and override_attributes.",
+					},
+
+					"declared_policy_prefixes": &framework.FieldSchema{
+						Type: framework.TypeCommaStringSlice,
+						Description: "Comma-separated list of prefixes declared policies " +
+							"must start with. Required with declared_policies.",
+					},
+
+					"alias_source": &framework.FieldSchema{
+						Type:    framework.TypeString,
+						Default: aliasSourceClientName,
+						Description: "What identity aliases are named after: 'client_name', " +
+							"'node_name' or 'attribute'.",
+					},
+
+					"alias_attribute": &framework.FieldSchema{
 						Type:        framework.TypeString,
-						Description: "Describes where to look for information about client roles.",
+						Description: "Node attribute naming identity aliases, e.g. automatic.fqdn.",
+					},
+
+					"group_alias_tags": &framework.FieldSchema{
+						Type:        framework.TypeBool,
+						Description: "Add an identity group alias per node tag.",
+					},
+
+					"token_metadata": &framework.FieldSchema{
+						Type: framework.TypeKVPairs,
+						Description: "Extra key=path pairs of token metadata read from the " +
+							"node object, or the data bag item for paths starting with 'data_bag.'.",
 					},
 
 					"ttl": &framework.FieldSchema{
@@ -143,6 +731,150 @@ For more information and examples, please see the online documentation.
 						Type:        framework.TypeDurationSecond,
 						Description: "Maximum duration after which authentication will expire.",
 					},
+
+					"period": &framework.FieldSchema{
+						Type:        framework.TypeDurationSecond,
+						Description: "If set, tokens are periodic and renewable for this period forever.",
+					},
+
+					"explicit_max_ttl": &framework.FieldSchema{
+						Type:        framework.TypeDurationSecond,
+						Description: "Hard limit of the token lifetime, renewals included.",
+					},
+
+					"num_uses": &framework.FieldSchema{
+						Type:        framework.TypeInt,
+						Description: "Number of times the token can be used, unlimited if 0.",
+					},
+
+					"bound_cidrs": &framework.FieldSchema{
+						Type:        framework.TypeCommaStringSlice,
+						Description: "Comma-separated list of CIDR blocks logins and tokens are allowed from.",
+					},
+
+					"token_type": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Type of the tokens, 'service', 'batch' or 'default'.",
+					},
+
+					"no_default_policy": &framework.FieldSchema{
+						Type:        framework.TypeBool,
+						Description: "Leave the 'default' policy out of the tokens.",
+					},
+
+					"bind_node_address": &framework.FieldSchema{
+						Type:        framework.TypeBool,
+						Description: "Only accept logins from the addresses Ohai reported for the node.",
+					},
+
+					"node_address_prefix": &framework.FieldSchema{
+						Type: framework.TypeInt,
+						Description: "Prefix length of the IPv4 networks around the node addresses " +
+							"logins are accepted from. Only the exact addresses if 0.",
+					},
+
+					"node_address6_prefix": &framework.FieldSchema{
+						Type: framework.TypeInt,
+						Description: "Prefix length of the IPv6 networks around the node addresses " +
+							"logins are accepted from. Only the exact addresses if 0.",
+					},
+
+					"node_address_data_bag_path": &framework.FieldSchema{
+						Type: framework.TypeString,
+						Description: "Path of the node addresses in the client's data bag item, " +
+							"read instead of the addresses reported by Ohai.",
+					},
+
+					"remote_addr_header": &framework.FieldSchema{
+						Type: framework.TypeString,
+						Description: "Header holding the client address when the request comes " +
+							"from a trusted proxy, e.g. X-Forwarded-For.",
+					},
+
+					"trusted_proxies": &framework.FieldSchema{
+						Type:        framework.TypeCommaStringSlice,
+						Description: "Comma-separated list of CIDR blocks of the trusted proxies.",
+					},
+
+					"renew_policy_change": &framework.FieldSchema{
+						Type:    framework.TypeString,
+						Default: renewPolicyChangeDeny,
+						Description: "How renewals handle policy changes: 'deny', 'allow_subset' " +
+							"or 'ignore_additions'.",
+					},
+
+					"max_node_staleness": &framework.FieldSchema{
+						Type: framework.TypeDurationSecond,
+						Description: "Refuse nodes whose last chef-client run, from automatic.ohai_time, " +
+							"is older. Disabled if 0.",
+					},
+
+					"environment_node_staleness": &framework.FieldSchema{
+						Type: framework.TypeKVPairs,
+						Description: "Env=duration pairs overriding max_node_staleness " +
+							"per environment, 0 disables the check.",
+					},
+
+					"machine_identity": &framework.FieldSchema{
+						Type: framework.TypeBool,
+						Description: "Bind clients to the fingerprint of the machine they first " +
+							"log in from.",
+					},
+
+					"machine_identity_source": &framework.FieldSchema{
+						Type:    framework.TypeString,
+						Default: machineIdentitySourceNode,
+						Description: "What is fingerprinted: 'node' for machine_identity_attributes " +
+							"of the node object, or 'login' for the machine_id field of the login.",
+					},
+
+					"machine_identity_attributes": &framework.FieldSchema{
+						Type: framework.TypeCommaStringSlice,
+						Description: "Comma-separated list of node attributes fingerprinted, " +
+							"automatic.dmi.system.uuid and automatic.machine_id by default.",
+					},
+
+					"approval_required": &framework.FieldSchema{
+						Type: framework.TypeBool,
+						Description: "Hold clients logging in for the first time in the pending " +
+							"queue until they are approved. Clients renewing a token issued " +
+							"before it was enabled are approved.",
+					},
+
+					"bootstrap_policies": &framework.FieldSchema{
+						Type: framework.TypeCommaStringSlice,
+						Description: "Comma-separated list of policies granted to clients pending " +
+							"approval, along with anyone_policies. Logins are refused if empty.",
+					},
+
+					"service_client": &framework.FieldSchema{
+						Type: framework.TypeString,
+						Description: "Name of the Chef API client used by the plugin " +
+							"to look up clients and nodes.",
+					},
+
+					"service_key": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Private key of the service client. It is never returned on read.",
+					},
+
+					"service_key_name": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Default:     "default",
+						Description: "Name of the service key in the Chef keys API.",
+					},
+
+					"max_clock_skew": &framework.FieldSchema{
+						Type:        framework.TypeDurationSecond,
+						Default:     300,
+						Description: "Maximum allowed age of a signed login request.",
+					},
+
+					"search_refresh": &framework.FieldSchema{
+						Type:        framework.TypeDurationSecond,
+						Default:     300,
+						Description: "Duration for which the results of search mappings are cached.",
+					},
 				},
 				Callbacks: map[logical.Operation]framework.OperationFunc{
 					logical.UpdateOperation: b.pathConfigWrite,
@@ -150,6 +882,23 @@ For more information and examples, please see the online documentation.
 				},
 			})
 
+			// auth/chef/config/rotate-root
+			paths = append(paths, &framework.Path{
+				Pattern:      "config/rotate-root",
+				HelpSynopsis: "Rotate the key of the service client",
+				HelpDescription: `
+
+Generates a new key for the configured service client with the Chef keys API,
+stores it in the configuration and deletes the previous key from the Chef
+server. The new key is never returned. The service client needs permission to
+manage its own keys.
+
+`,
+				Callbacks: map[logical.Operation]framework.OperationFunc{
+					logical.UpdateOperation: b.pathRotateRoot,
+				},
+			})
+
 			// auth/chef/login/key
 			paths = append(paths, &framework.Path{
 				Pattern:      "login/key",
@@ -172,12 +921,76 @@ then used to map the client to policies in Vault.
 						Description: "Chef client name to use for " +
 							"authentication.",
 					},
+					"role": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Optional login role to authenticate against.",
+					},
+					"machine_id": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Machine identity with machine_identity_source=login.",
+					},
 				},
 				Callbacks: map[logical.Operation]framework.OperationFunc{
 					logical.UpdateOperation: b.pathAuthLogin,
 				},
 			})
 
+			// auth/chef/login/signed
+			paths = append(paths, &framework.Path{
+				Pattern:      "login/signed",
+				HelpSynopsis: "Authenticate using a request signed with a chef client key",
+				HelpDescription: `
+
+Accepts a login request signed with a client's Chef private key in the same
+way Chef signs its API requests (X-Ops-Sign version 1.0). The signature is
+verified against the client's public key fetched from the Chef server with
+the configured service credential, so the private key never leaves the node.
+
+The signed content is:
+
+    Method:POST
+    Hashed Path:<base64 sha1 of /v1/auth/<mount>/login/signed>
+    X-Ops-Content-Hash:<base64 sha1 of the sorted key=value login fields, joined by '&', without 'signature'>
+    X-Ops-Timestamp:<timestamp>
+    X-Ops-UserId:<client>
+
+Every client, timestamp and nonce can be used only once, so clients logging
+in more than once within the same second must send a distinct nonce.
+
+`,
+				Fields: map[string]*framework.FieldSchema{
+					"client": &framework.FieldSchema{
+						Type: framework.TypeString,
+						Description: "Chef client name to use for " +
+							"authentication.",
+					},
+					"timestamp": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "RFC3339 UTC time at which the request was signed.",
+					},
+					"signature": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Base64 encoded signature of the canonical request.",
+					},
+					"role": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Optional login role to authenticate against.",
+					},
+					"machine_id": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Machine identity with machine_identity_source=login, covered by the signature.",
+					},
+					"nonce": &framework.FieldSchema{
+						Type: framework.TypeString,
+						Description: "Random value covered by the signature, required to log in " +
+							"more than once within the same second.",
+					},
+				},
+				Callbacks: map[logical.Operation]framework.OperationFunc{
+					logical.UpdateOperation: b.pathAuthLoginSigned,
+				},
+			})
+
 			return paths
 		}(),
 	}
@@ -185,6 +998,12 @@ then used to map the client to policies in Vault.
 	return &b
 }
 
+// periodicFunc is invoked by Vault on every rollback tick to clean up stale
+// entries in storage.
+func (b *backend) periodicFunc(ctx context.Context, req *logical.Request) error {
+	return b.tidySignatures(ctx, req.Storage)
+}
+
 const backendHelp = `
 TODO
 `
@@ -0,0 +1,175 @@
+package chefclient
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+
+	"github.com/go-chef/chef"
+	"github.com/pkg/errors"
+)
+
+// chefNode is a Chef node object along with the fields go-chef does not
+// decode.
+type chefNode struct {
+	chef.Node
+	PolicyName  string `json:"policy_name,omitempty"`
+	PolicyGroup string `json:"policy_group,omitempty"`
+
+	// raw is the node JSON as returned by the server, for attribute lookups.
+	raw []byte
+}
+
+// getNode fetches the named node object from the Chef server.
+func getNode(c *chef.Client, name string) (*chefNode, error) {
+	var raw json.RawMessage
+	if err := chefRequest(c, "GET", "nodes/"+name, nil, &raw); err != nil {
+		return nil, errors.Wrapf(err, "failed to get node %q", name)
+	}
+
+	var node chefNode
+	if err := json.Unmarshal(raw, &node); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode node %q", name)
+	}
+	node.raw = raw
+	return &node, nil
+}
+
+// newChefClient builds a Chef API client which signs its requests as the
+// given client name and private key.
+func newChefClient(config *config, name, key string) (*chef.Client, error) {
+	c, err := chef.NewClient(&chef.Config{
+		Name:    name,
+		Key:     key,
+		BaseURL: config.ChefServer,
+		SkipSSL: config.SkipTLS,
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create chef client %q", name)
+	}
+	return c, nil
+}
+
+// serviceClient builds a Chef API client from the plugin-owned service
+// credential.
+func serviceClient(config *config) (*chef.Client, error) {
+	if config.ServiceClient == "" || config.ServiceKey == "" {
+		return nil, errors.New("no service credential configured")
+	}
+	return newChefClient(config, config.ServiceClient, config.ServiceKey)
+}
+
+// clientPublicKeys fetches all non-expired public keys of a Chef client. The
+// keys API is used when the server supports it, otherwise the key stored on
+// the client object is used.
+func clientPublicKeys(c *chef.Client, name string) ([]*rsa.PublicKey, error) {
+	var pems []string
+
+	keys, err := c.Clients.ListKeys(name)
+	if err == nil && keys != nil {
+		for _, k := range *keys {
+			if k.Expired {
+				continue
+			}
+			key, err := c.Clients.GetKey(name, k.Name)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to get key %q of client %q", k.Name, name)
+			}
+			pems = append(pems, key.PublicKey)
+		}
+	} else {
+		client, err := c.Clients.Get(name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get client %q", name)
+		}
+		pems = append(pems, client.PublicKey)
+	}
+
+	pubKeys := make([]*rsa.PublicKey, 0, len(pems))
+	for _, p := range pems {
+		pub, err := parsePublicKey(p)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse public key of client %q", name)
+		}
+		pubKeys = append(pubKeys, pub)
+	}
+	if len(pubKeys) == 0 {
+		return nil, fmt.Errorf("client %q has no valid public keys", name)
+	}
+	return pubKeys, nil
+}
+
+// parsePublicKey parses a PEM encoded RSA public key as returned by the Chef
+// server. PKIX, PKCS#1 and certificate encodings are accepted.
+func parsePublicKey(data string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		pub, ok := cert.PublicKey.(*rsa.PublicKey)
+		if !ok {
+			return nil, errors.New("certificate does not hold an RSA key")
+		}
+		return pub, nil
+	default:
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, errors.New("not an RSA public key")
+		}
+		return pub, nil
+	}
+}
+
+// chefRequest performs a request on a Chef API endpoint go-chef does not wrap
+// and decodes the JSON response into v, if given.
+func chefRequest(c *chef.Client, method, path string, body interface{}, v interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		var err error
+		reader, err = chef.JSONReader(body)
+		if err != nil {
+			return errors.Wrap(err, "failed to encode request body")
+		}
+	}
+
+	req, err := c.NewRequest(method, path, reader)
+	if err != nil {
+		return errors.Wrap(err, "failed to create request")
+	}
+	res, err := c.Do(req, v)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	return err
+}
+
+// keyMatches reports whether the PEM encoded private key belongs to any of
+// the given public keys.
+func keyMatches(key string, pubKeys []*rsa.PublicKey) bool {
+	priv, err := chef.PrivateKeyFromString([]byte(key))
+	if err != nil {
+		return false
+	}
+	for _, pub := range pubKeys {
+		if pub.E == priv.E && pub.N.Cmp(priv.N) == 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -4,10 +4,18 @@ import (
 	"context"
 	"time"
 
-	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/sdk/logical"
 	"github.com/pkg/errors"
 )
 
+// defaultMaxClockSkew is the maximum age of signed login requests of
+// configurations written before it could be set.
+const defaultMaxClockSkew = 5 * time.Minute
+
+// defaultSearchRefresh is how long search results are cached for
+// configurations written before it could be set.
+const defaultSearchRefresh = 5 * time.Minute
+
 // config represents the internally stored configuration information.
 type config struct {
 	ChefServer string `json:"chef_server" structs:"chef_server"`
@@ -16,12 +24,109 @@ type config struct {
 	AnyonePolicies []string `json:"anyone_policies" structs:"anyone_policies,omitempty"`
 	// DataBags is the list of Ched Server data bags that should be checked for client data bag file.
 	DataBags []string `json:"data_bags" structs:"data_bags"`
-	// RunListSrc defines where to look for run_list informations.
+	// DataBagItem is the template of the client's data bag item name.
+	DataBagItem string `json:"data_bag_item" structs:"data_bag_item"`
+	// DataBagRunListPath, DataBagEnvironmentPath and DataBagNamePath are the
+	// paths of the run_list, environment and display name in the data bag
+	// item.
+	DataBagRunListPath     string `json:"data_bag_run_list_path" structs:"data_bag_run_list_path"`
+	DataBagEnvironmentPath string `json:"data_bag_environment_path" structs:"data_bag_environment_path"`
+	DataBagNamePath        string `json:"data_bag_name_path" structs:"data_bag_name_path"`
+	// DataBagFields maps extra policy templates and token metadata to paths
+	// in the data bag item.
+	DataBagFields map[string]string `json:"data_bag_fields" structs:"data_bag_fields"`
+	// DataBagSecret is the shared secret of encrypted data bags. It is never
+	// returned when reading the configuration.
+	DataBagSecret string `json:"data_bag_secret" structs:"-"`
+	// RunListSrc defines where to look for run_list informations, as a
+	// comma-separated list of sources.
 	RunListSrc string `json:"run_list_src" structs:"run_list_src"`
+	// RunListMerge defines how the run lists of several sources are merged.
+	RunListMerge string `json:"run_list_merge" structs:"run_list_merge"`
+	// RunListExpansion defines how nested roles are expanded.
+	RunListExpansion string `json:"run_list_expansion" structs:"run_list_expansion"`
+
+	// DeclaredPolicies enables the policies declared in the attribute at
+	// DeclaredPolicyAttribute of roles and environments. Only policies
+	// starting with one of DeclaredPolicyPrefixes are granted.
+	DeclaredPolicies        bool     `json:"declared_policies" structs:"declared_policies"`
+	DeclaredPolicyAttribute string   `json:"declared_policy_attribute" structs:"declared_policy_attribute"`
+	DeclaredPolicyPrefixes  []string `json:"declared_policy_prefixes" structs:"declared_policy_prefixes"`
+
+	// ServiceClient and ServiceKey are the Chef API credential owned by the
+	// plugin. The key is never returned when reading the configuration.
+	ServiceClient string `json:"service_client" structs:"service_client"`
+	ServiceKey    string `json:"service_key" structs:"-"`
+	// ServiceKeyName is the name of ServiceKey in the Chef keys API, it is
+	// retired when the key is rotated.
+	ServiceKeyName string `json:"service_key_name" structs:"service_key_name"`
+	// MaxClockSkew is the allowed difference between the signed login
+	// timestamp and the Vault server time.
+	MaxClockSkew time.Duration `json:"max_clock_skew" structs:"max_clock_skew,omitempty"`
+	// SearchRefresh is how long the results of search mappings are cached.
+	SearchRefresh time.Duration `json:"search_refresh" structs:"search_refresh,omitempty"`
+
+	// AliasSource defines what identity aliases are named after, AliasAttribute
+	// is the node attribute used by the attribute source.
+	AliasSource    string `json:"alias_source" structs:"alias_source"`
+	AliasAttribute string `json:"alias_attribute" structs:"alias_attribute"`
+	// GroupAliasTags adds a group alias per node tag.
+	GroupAliasTags bool `json:"group_alias_tags" structs:"group_alias_tags"`
+
+	// TokenMetadata maps token metadata keys to node attribute paths.
+	TokenMetadata map[string]string `json:"token_metadata" structs:"token_metadata"`
 
 	// TTL and MaxTTL are the default TTLs.
 	TTL    time.Duration `json:"ttl" structs:"ttl,omitempty"`
 	MaxTTL time.Duration `json:"max_ttl" structs:"max_ttl,omitempty"`
+
+	// Period, ExplicitMaxTTL, NumUses, BoundCIDRs, TokenType and
+	// NoDefaultPolicy are the default token settings, login roles and
+	// mappings can override them.
+	Period          time.Duration `json:"period" structs:"period,omitempty"`
+	ExplicitMaxTTL  time.Duration `json:"explicit_max_ttl" structs:"explicit_max_ttl,omitempty"`
+	NumUses         int           `json:"num_uses" structs:"num_uses,omitempty"`
+	BoundCIDRs      []string      `json:"bound_cidrs" structs:"bound_cidrs,omitempty"`
+	TokenType       string        `json:"token_type" structs:"token_type,omitempty"`
+	NoDefaultPolicy bool          `json:"no_default_policy" structs:"no_default_policy"`
+
+	// BindNodeAddress only accepts logins from the addresses Ohai reported
+	// for the node, or from their networks with NodeAddressPrefix and
+	// NodeAddress6Prefix.
+	BindNodeAddress    bool `json:"bind_node_address" structs:"bind_node_address"`
+	NodeAddressPrefix  int  `json:"node_address_prefix" structs:"node_address_prefix,omitempty"`
+	NodeAddress6Prefix int  `json:"node_address6_prefix" structs:"node_address6_prefix,omitempty"`
+	// NodeAddressDataBagPath reads the node addresses from this path of the
+	// client's data bag item instead of Ohai.
+	NodeAddressDataBagPath string `json:"node_address_data_bag_path" structs:"node_address_data_bag_path"`
+	// RemoteAddrHeader is the header holding the client address when the
+	// request comes from one of TrustedProxies, e.g. X-Forwarded-For.
+	RemoteAddrHeader string   `json:"remote_addr_header" structs:"remote_addr_header"`
+	TrustedProxies   []string `json:"trusted_proxies" structs:"trusted_proxies"`
+
+	// RenewPolicyChange defines how renewals handle policy changes.
+	RenewPolicyChange string `json:"renew_policy_change" structs:"renew_policy_change"`
+
+	// MaxNodeStaleness refuses nodes whose last chef-client run is older,
+	// EnvNodeStaleness overrides it per environment.
+	MaxNodeStaleness time.Duration            `json:"max_node_staleness" structs:"max_node_staleness,omitempty"`
+	EnvNodeStaleness map[string]time.Duration `json:"environment_node_staleness" structs:"environment_node_staleness"`
+
+	// MachineIdentity binds clients on first login to the fingerprint of the
+	// MachineIdentityAttributes of their node, or with the login
+	// MachineIdentitySource to the machine_id they log in with.
+	MachineIdentity           bool     `json:"machine_identity" structs:"machine_identity"`
+	MachineIdentitySource     string   `json:"machine_identity_source" structs:"machine_identity_source"`
+	MachineIdentityAttributes []string `json:"machine_identity_attributes" structs:"machine_identity_attributes"`
+
+	// ApprovalRequired holds clients not approved yet in a pending queue,
+	// they get BootstrapPolicies or are refused if there are none.
+	ApprovalRequired  bool     `json:"approval_required" structs:"approval_required"`
+	BootstrapPolicies []string `json:"bootstrap_policies" structs:"bootstrap_policies"`
+	// ApprovalRequiredSince is when approval was first enabled, clients
+	// renewing a token issued before are approved. It is kept while
+	// approval is disabled.
+	ApprovalRequiredSince time.Time `json:"approval_required_since" structs:"-"`
 }
 
 // Config parses and returns the configuration data from the storage backend.
@@ -39,5 +144,43 @@ func (b *backend) Config(ctx context.Context, s logical.Storage) (*config, error
 		return nil, errors.Wrapf(err, "failed to decode configuration")
 	}
 
+	// Configurations written before the run list sources could be layered
+	if result.RunListMerge == "" {
+		result.RunListMerge = runListMergeUnion
+	}
+
+	// Configurations written before renewals could tolerate policy changes
+	if result.RenewPolicyChange == "" {
+		result.RenewPolicyChange = renewPolicyChangeDeny
+	}
+
+	// Configurations written before signed logins
+	if result.MaxClockSkew == 0 {
+		result.MaxClockSkew = defaultMaxClockSkew
+	}
+
+	// Configurations written before the declared policy prefixes were
+	// lowercased
+	result.DeclaredPolicyPrefixes = lowerPrefixes(result.DeclaredPolicyPrefixes)
+
+	// Configurations written before the machine identity could come from
+	// the login
+	if result.MachineIdentitySource == "" {
+		result.MachineIdentitySource = machineIdentitySourceNode
+	}
+
+	// Configurations written before search mappings
+	if result.SearchRefresh == 0 {
+		result.SearchRefresh = defaultSearchRefresh
+	}
+
+	// Configurations written before the data bag schema was configurable
+	if result.DataBagItem == "" {
+		result.DataBagItem = defaultDataBagItem
+		result.DataBagRunListPath = defaultDataBagRunListPath
+		result.DataBagEnvironmentPath = defaultDataBagEnvironmentPath
+		result.DataBagNamePath = defaultDataBagNamePath
+	}
+
 	return &result, nil
 }
@@ -0,0 +1,41 @@
+package chefclient
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// TestConfigDefaults reads a configuration written before the optional
+// settings existed.
+func TestConfigDefaults(t *testing.T) {
+	ctx := context.Background()
+	s := &logical.InmemStorage{}
+	b := &backend{}
+
+	entry := &logical.StorageEntry{
+		Key:   "config",
+		Value: []byte(`{"chef_server": "https://chef.example.com/organizations/example", "run_list_src": "node"}`),
+	}
+	if err := s.Put(ctx, entry); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := b.Config(ctx, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.MaxClockSkew != defaultMaxClockSkew {
+		t.Errorf("expected max_clock_skew %s, got %s", defaultMaxClockSkew, config.MaxClockSkew)
+	}
+	if config.SearchRefresh != defaultSearchRefresh {
+		t.Errorf("expected search_refresh %s, got %s", defaultSearchRefresh, config.SearchRefresh)
+	}
+	if config.RunListMerge != runListMergeUnion {
+		t.Errorf("expected run_list_merge %s, got %s", runListMergeUnion, config.RunListMerge)
+	}
+	if config.RenewPolicyChange != renewPolicyChangeDeny {
+		t.Errorf("expected renew_policy_change %s, got %s", renewPolicyChangeDeny, config.RenewPolicyChange)
+	}
+}
@@ -0,0 +1,124 @@
+package chefclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/go-chef/chef"
+	"github.com/pkg/errors"
+	"github.com/tidwall/gjson"
+)
+
+const (
+	// Defaults of the data bag schema, matching the original fixed layout.
+	defaultDataBagItem            = "{{client}}"
+	defaultDataBagRunListPath     = "run_list"
+	defaultDataBagEnvironmentPath = "env"
+	defaultDataBagNamePath        = "id"
+)
+
+// dataBagFieldRe matches the names of the extra data bag fields, which are
+// used as policy templates and token metadata keys.
+var dataBagFieldRe = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+// dataBagItemRe matches valid data bag item names.
+var dataBagItemRe = regexp.MustCompile(`^[-\w.]+$`)
+
+// reservedTemplates are the built-in policy template names a data bag field
+// cannot take.
+var reservedTemplates = []string{"env", "name", "policy_name", "policy_group", "tag"}
+
+// dataBagItemName renders the data bag item name template for the client.
+// The template can use {{client}} and {{short_name}}, the client name up to
+// its first dot, along with the replace, lower and upper functions, e.g.
+// {{client | replace "." "_"}}.
+func dataBagItemName(text, client string) (string, error) {
+	tmpl, err := template.New("data_bag_item").Funcs(template.FuncMap{
+		"client":     func() string { return client },
+		"short_name": func() string { return strings.SplitN(client, ".", 2)[0] },
+		"replace":    func(old, new, s string) string { return strings.Replace(s, old, new, -1) },
+		"lower":      strings.ToLower,
+		"upper":      strings.ToUpper,
+	}).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, nil); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// validateDataBagFields checks the names of the extra data bag fields.
+func validateDataBagFields(fields map[string]string) error {
+	for name, path := range fields {
+		if !dataBagFieldRe.MatchString(name) {
+			return fmt.Errorf("field name %q must only contain lowercase letters, digits and underscores", name)
+		}
+		for _, reserved := range reservedTemplates {
+			if name == reserved {
+				return fmt.Errorf("field name %q is reserved", name)
+			}
+		}
+		if path == "" {
+			return fmt.Errorf("field %q has no path", name)
+		}
+	}
+	return nil
+}
+
+// getDataBagItem fetches the raw JSON of the client's item from the first
+// configured data bag holding it, or nil if none holds it.
+func getDataBagItem(config *config, c *chef.Client, client string, b *backend) ([]byte, error) {
+	name, err := dataBagItemName(config.DataBagItem, client)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to render data bag item name")
+	}
+	if !dataBagItemRe.MatchString(name) {
+		return nil, fmt.Errorf("invalid data bag item name %q", name)
+	}
+
+	// Iterate over configured data bags and try to find the one for our client
+	for _, dataBag := range config.DataBags {
+		var raw json.RawMessage
+		err := chefRequest(c, "GET", "data/"+dataBag+"/"+name, nil, &raw)
+		if err == nil {
+			return raw, nil
+		}
+		if resp, ok := err.(*chef.ErrorResponse); ok && resp.Response.StatusCode == http.StatusNotFound {
+			b.logger.Debug(fmt.Sprintf("Data bag item %s not found in %s", name, dataBag))
+			continue
+		}
+		return nil, errors.Wrapf(err, "failed to get data bag item %q from %q", name, dataBag)
+	}
+	return nil, nil
+}
+
+// parseDataBagItem reads the run_list, environment, name and extra fields of
+// a data bag item according to the configured paths.
+func parseDataBagItem(config *config, raw []byte) *runList {
+	items := make([]string, 0)
+	for _, item := range gjson.GetBytes(raw, config.DataBagRunListPath).Array() {
+		items = append(items, item.String())
+	}
+
+	item := &runList{
+		env:    gjson.GetBytes(raw, config.DataBagEnvironmentPath).String(),
+		name:   gjson.GetBytes(raw, config.DataBagNamePath).String(),
+		fields: make(map[string]string, len(config.DataBagFields)),
+
+		dataBag: raw,
+	}
+	item.roles, item.recipes = parseRunList(items)
+	for name, path := range config.DataBagFields {
+		item.fields[name] = gjson.GetBytes(raw, path).String()
+	}
+	return item
+}
@@ -0,0 +1,100 @@
+package chefclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-chef/chef"
+	"github.com/pkg/errors"
+	"github.com/tidwall/gjson"
+)
+
+// declaredPolicies reads the Vault policies declared in the default and
+// override attributes of the node's roles and environment. Policies outside
+// the configured prefixes are dropped.
+func (b *backend) declaredPolicies(config *config, c *chef.Client, roles []string, env string) ([]string, error) {
+	// The names end up in the Chef API paths
+	objects := make([]string, 0, len(roles)+1)
+	for _, role := range roles {
+		if !chefObjectNameRe.MatchString(role) {
+			b.logger.Warn(fmt.Sprintf("Role %q is not a valid role name, ignoring its declared policies", role))
+			continue
+		}
+		objects = append(objects, "roles/"+role)
+	}
+	if env != "" {
+		if chefObjectNameRe.MatchString(env) {
+			objects = append(objects, "environments/"+env)
+		} else {
+			b.logger.Warn(fmt.Sprintf("Environment %q is not a valid environment name, ignoring its declared policies", env))
+		}
+	}
+
+	policies := newStringSet()
+	for _, object := range objects {
+		var raw json.RawMessage
+		if err := chefRequest(c, "GET", object, nil, &raw); err != nil {
+			if resp, ok := err.(*chef.ErrorResponse); ok && resp.Response.StatusCode == http.StatusNotFound {
+				b.logger.Warn(fmt.Sprintf("Object %s declaring policies does not exist", object))
+				continue
+			}
+			return nil, errors.Wrapf(err, "failed to get %s", object)
+		}
+
+		for _, p := range declaredAttribute(raw, config.DeclaredPolicyAttribute) {
+			if !hasAnyPrefix(p, config.DeclaredPolicyPrefixes) {
+				b.logger.Warn(fmt.Sprintf("Ignoring policy %s declared by %s outside of the allowed prefixes", p, object))
+				continue
+			}
+			policies.add(p)
+		}
+	}
+	return policies.list(), nil
+}
+
+// declaredAttribute returns the policies listed in the default and override
+// attribute at path of a role or environment object. The attribute can be a
+// list or a comma-separated string.
+func declaredAttribute(raw []byte, path string) []string {
+	result := make([]string, 0)
+	for _, precedence := range []string{"default_attributes", "override_attributes"} {
+		attr := gjson.GetBytes(raw, precedence+"."+path)
+		items := attr.Array()
+		if attr.Type == gjson.String {
+			items = nil
+			for _, p := range strings.Split(attr.Str, ",") {
+				items = append(items, gjson.Result{Type: gjson.String, Str: p})
+			}
+		}
+		for _, item := range items {
+			if p := strings.ToLower(strings.TrimSpace(item.String())); p != "" {
+				result = append(result, p)
+			}
+		}
+	}
+	return result
+}
+
+// lowerPrefixes lowercases the policy prefixes, as policy names are, and
+// drops the empty ones.
+func lowerPrefixes(prefixes []string) []string {
+	result := make([]string, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		if prefix = strings.ToLower(strings.TrimSpace(prefix)); prefix != "" {
+			result = append(result, prefix)
+		}
+	}
+	return result
+}
+
+// hasAnyPrefix reports whether s starts with any of the prefixes.
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if prefix != "" && strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,39 @@
+package chefclient
+
+import (
+	"testing"
+
+	log "github.com/hashicorp/go-hclog"
+)
+
+// TestDeclaredPoliciesObjectNames checks roles and environments which are
+// not valid Chef names are never requested: the client is nil and would
+// panic.
+func TestDeclaredPoliciesObjectNames(t *testing.T) {
+	b := &backend{logger: log.NewNullLogger()}
+	config := &config{DeclaredPolicyAttribute: "vault.policies"}
+
+	cases := []struct {
+		name  string
+		roles []string
+		env   string
+	}{
+		{"role traversal", []string{"../clients/web-01", "web/.."}, ""},
+		{"role dot segments", []string{"..", "."}, ""},
+		{"role query", []string{"web?x", "web%2F.."}, ""},
+		{"environment traversal", nil, "../roles/admin"},
+		{"environment dot segment", nil, ".."},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			policies, err := b.declaredPolicies(config, nil, tc.roles, tc.env)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(policies) != 0 {
+				t.Fatalf("expected no policies, got %v", policies)
+			}
+		})
+	}
+}
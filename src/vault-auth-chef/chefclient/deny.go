@@ -0,0 +1,102 @@
+package chefclient
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/pkg/errors"
+	glob "github.com/ryanuber/go-glob"
+)
+
+// denyPrefix is the storage prefix of the deny lists, followed by the kind
+// of the entry.
+const denyPrefix = "deny/"
+
+// denyKinds are the deny lists, matched against the client and node names,
+// the expanded roles and the environment.
+var denyKinds = []string{"hosts", "roles", "environments"}
+
+// denyEntry refuses the clients matching its glob pattern until it expires.
+type denyEntry struct {
+	Reason  string    `json:"reason"`
+	Expires time.Time `json:"expires"`
+}
+
+// expired reports whether the entry has an expiry in the past.
+func (e *denyEntry) expired(now time.Time) bool {
+	return !e.Expires.IsZero() && now.After(e.Expires)
+}
+
+// Deny returns the deny entry of the kind and pattern, or nil if there is
+// none.
+func (b *backend) Deny(ctx context.Context, s logical.Storage, kind, pattern string) (*denyEntry, error) {
+	entry, err := s.Get(ctx, denyPrefix+kind+"/"+pattern)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get deny entry from storage")
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var result denyEntry
+	if err := entry.DecodeJSON(&result); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode deny entry")
+	}
+	return &result, nil
+}
+
+// checkDenied fails if an unexpired deny entry matches the client or node
+// name, one of the roles or the environment.
+func (b *backend) checkDenied(ctx context.Context, s logical.Storage, client string, node *chefNode, roles []string) error {
+	values := map[string][]string{
+		"hosts":        []string{client, node.Name},
+		"roles":        roles,
+		"environments": []string{node.Environment},
+	}
+
+	now := time.Now()
+	for _, kind := range denyKinds {
+		patterns, err := s.List(ctx, denyPrefix+kind+"/")
+		if err != nil {
+			return errors.Wrapf(err, "failed to list deny entries")
+		}
+
+		for _, pattern := range patterns {
+			value, ok := globMatch(pattern, values[kind])
+			if !ok {
+				continue
+			}
+
+			deny, err := b.Deny(ctx, s, kind, pattern)
+			if err != nil {
+				return err
+			}
+			if deny == nil || deny.expired(now) {
+				continue
+			}
+
+			msg := fmt.Sprintf("%s denied by deny/%s/%s", value, kind, pattern)
+			if deny.Reason != "" {
+				msg += ": " + deny.Reason
+			}
+			return logical.CodedError(403, msg)
+		}
+	}
+	return nil
+}
+
+// globMatch returns the first non-empty value matching the glob pattern,
+// ignoring case. Patterns are lowercased when written, those written before
+// are lowercased here.
+func globMatch(pattern string, values []string) (string, bool) {
+	pattern = strings.ToLower(pattern)
+	for _, value := range values {
+		if value != "" && glob.Glob(pattern, strings.ToLower(value)) {
+			return value, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,31 @@
+package chefclient
+
+import (
+	"testing"
+)
+
+func TestGlobMatch(t *testing.T) {
+	cases := []struct {
+		name    string
+		pattern string
+		values  []string
+		want    string
+	}{
+		{"exact", "web-01", []string{"web-01"}, "web-01"},
+		{"glob", "db-*", []string{"web-01", "db-02"}, "db-02"},
+		{"no match", "db-*", []string{"web-01"}, ""},
+		{"value case", "web-*", []string{"WEB-01.example.com"}, "WEB-01.example.com"},
+		{"pattern case", "Web-*", []string{"web-01"}, "web-01"},
+		{"empty values are skipped", "*", []string{"", "web-01"}, "web-01"},
+		{"no values", "*", nil, ""},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := globMatch(tc.pattern, tc.values)
+			if ok != (tc.want != "") || got != tc.want {
+				t.Fatalf("expected %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,197 @@
+package chefclient
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// encryptedValue is an encrypted field of a Chef encrypted data bag item.
+type encryptedValue struct {
+	EncryptedData string `json:"encrypted_data"`
+	IV            string `json:"iv"`
+	Version       int    `json:"version"`
+	Cipher        string `json:"cipher"`
+	HMAC          string `json:"hmac"`
+	AuthTag       string `json:"auth_tag"`
+}
+
+// decryptDataBagItem decrypts the fields of a Chef encrypted data bag item,
+// returning the item JSON unchanged when it is not encrypted. Every field
+// but id is encrypted separately in the version 1, 2 or 3 format.
+func decryptDataBagItem(raw []byte, secret string) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, errors.Wrap(err, "failed to decode data bag item")
+	}
+
+	encrypted := false
+	for name, field := range fields {
+		if name == "id" {
+			continue
+		}
+
+		var value encryptedValue
+		if err := json.Unmarshal(field, &value); err != nil || !value.encrypted() {
+			continue
+		}
+		if secret == "" {
+			return nil, errors.New("data bag item is encrypted but no data_bag_secret is configured")
+		}
+
+		plain, err := value.decrypt(secret)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to decrypt field %q", name)
+		}
+		fields[name] = plain
+		encrypted = true
+	}
+	if !encrypted {
+		return raw, nil
+	}
+
+	return json.Marshal(fields)
+}
+
+// encrypted reports whether the field looks like an encrypted value. A field
+// with a version and only some of the other encryption fields is encrypted,
+// so that a truncated value fails to decrypt rather than passing as plain.
+func (v *encryptedValue) encrypted() bool {
+	return v.Version != 0 && (v.EncryptedData != "" || v.IV != "" || v.Cipher != "")
+}
+
+// decrypt decrypts the field with the shared secret and unwraps its value.
+func (v *encryptedValue) decrypt(secret string) (json.RawMessage, error) {
+	key := sha256.Sum256([]byte(secret))
+
+	if v.EncryptedData == "" {
+		return nil, errors.New("missing encrypted_data")
+	}
+	if v.IV == "" {
+		return nil, errors.New("missing iv")
+	}
+
+	data, err := base64.StdEncoding.DecodeString(stripWhitespace(v.EncryptedData))
+	if err != nil {
+		return nil, errors.Wrap(err, "bad encrypted_data")
+	}
+	iv, err := base64.StdEncoding.DecodeString(stripWhitespace(v.IV))
+	if err != nil {
+		return nil, errors.Wrap(err, "bad iv")
+	}
+
+	var plain []byte
+	switch v.Version {
+	case 1, 2:
+		if v.Cipher != "" && v.Cipher != "aes-256-cbc" {
+			return nil, fmt.Errorf("unsupported cipher %q", v.Cipher)
+		}
+		if v.Version == 2 {
+			if err := v.checkHMAC(secret); err != nil {
+				return nil, err
+			}
+		}
+		plain, err = decryptCBC(key[:], iv, data)
+	case 3:
+		if v.Cipher != "" && v.Cipher != "aes-256-gcm" {
+			return nil, fmt.Errorf("unsupported cipher %q", v.Cipher)
+		}
+		var tag []byte
+		tag, err = base64.StdEncoding.DecodeString(stripWhitespace(v.AuthTag))
+		if err != nil {
+			return nil, errors.Wrap(err, "bad auth_tag")
+		}
+		plain, err = decryptGCM(key[:], iv, data, tag)
+	default:
+		return nil, fmt.Errorf("unsupported encrypted data bag version %d", v.Version)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Chef wraps the value, which may not be an object, before encryption
+	var wrapper struct {
+		JSONWrapper json.RawMessage `json:"json_wrapper"`
+	}
+	if err := json.Unmarshal(plain, &wrapper); err != nil {
+		return nil, errors.New("decrypted data is not valid, the secret may be wrong")
+	}
+	return wrapper.JSONWrapper, nil
+}
+
+// checkHMAC verifies the HMAC of a version 2 field, computed with the secret
+// over the base64 encrypted data as stored.
+func (v *encryptedValue) checkHMAC(secret string) error {
+	expected, err := base64.StdEncoding.DecodeString(stripWhitespace(v.HMAC))
+	if err != nil {
+		return errors.Wrap(err, "bad hmac")
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(v.EncryptedData))
+	if !hmac.Equal(mac.Sum(nil), expected) {
+		return errors.New("hmac does not match, the secret may be wrong")
+	}
+	return nil
+}
+
+// decryptCBC decrypts AES-256-CBC data and removes its PKCS#7 padding.
+func decryptCBC(key, iv, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != block.BlockSize() {
+		return nil, errors.New("bad iv length")
+	}
+	if len(data) == 0 || len(data)%block.BlockSize() != 0 {
+		return nil, errors.New("bad encrypted data length")
+	}
+
+	plain := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, data)
+
+	pad := int(plain[len(plain)-1])
+	if pad == 0 || pad > block.BlockSize() {
+		return nil, errors.New("bad padding, the secret may be wrong")
+	}
+	for _, c := range plain[len(plain)-pad:] {
+		if int(c) != pad {
+			return nil, errors.New("bad padding, the secret may be wrong")
+		}
+	}
+	return plain[:len(plain)-pad], nil
+}
+
+// decryptGCM decrypts and authenticates AES-256-GCM data.
+func decryptGCM(key, iv, data, tag []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(iv))
+	if err != nil {
+		return nil, err
+	}
+	if len(tag) != gcm.Overhead() {
+		return nil, errors.New("bad auth_tag length")
+	}
+
+	plain, err := gcm.Open(nil, iv, append(data, tag...), nil)
+	if err != nil {
+		return nil, errors.New("authentication failed, the secret may be wrong")
+	}
+	return plain, nil
+}
+
+// stripWhitespace removes the line breaks Ruby adds to base64 data.
+func stripWhitespace(s string) string {
+	return strings.Join(strings.Fields(s), "")
+}
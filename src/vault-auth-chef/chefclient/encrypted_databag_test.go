@@ -0,0 +1,221 @@
+package chefclient
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// The fixtures are encrypted the way knife does with dataBagTestSecret,
+// base64 data included: Ruby wraps it at 60 characters.
+const dataBagTestSecret = "vault-auth-chef test secret"
+
+const (
+	dataBagItemV1 = `{
+  "id": "web-01",
+  "environment": {
+    "encrypted_data": "ECxuIinxYKh/ttZ4AlMsmLNw2yeNSETC1t7z9g+/pb0=\n",
+    "iv": "AQIDBAUGBwgJCgsMDQ4PEA==\n",
+    "version": 1,
+    "cipher": "aes-256-cbc"
+  },
+  "run_list": {
+    "encrypted_data": "5GdHTbNXZ93o5b2utJDRQH4EZ6xeUkBdu20b9i2ZZn+BJr/SxHnd7+b5mMXa\njfgi\n",
+    "iv": "ZWZnaGlqa2xtbm9wcXJzdA==\n",
+    "version": 1,
+    "cipher": "aes-256-cbc"
+  }
+}`
+
+	dataBagItemV2 = `{
+  "id": "web-01",
+  "environment": {
+    "encrypted_data": "ECxuIinxYKh/ttZ4AlMsmLNw2yeNSETC1t7z9g+/pb0=\n",
+    "hmac": "uGX/39LOEYU36f8mySQUuNVJrw3k/q6PYZGgqby02dU=\n",
+    "iv": "AQIDBAUGBwgJCgsMDQ4PEA==\n",
+    "version": 2,
+    "cipher": "aes-256-cbc"
+  },
+  "run_list": {
+    "encrypted_data": "5GdHTbNXZ93o5b2utJDRQH4EZ6xeUkBdu20b9i2ZZn+BJr/SxHnd7+b5mMXa\njfgi\n",
+    "hmac": "3OxLVDjFt0NqYeka1fTIrQ87EhBkNsPcbjAIElEQwLQ=\n",
+    "iv": "ZWZnaGlqa2xtbm9wcXJzdA==\n",
+    "version": 2,
+    "cipher": "aes-256-cbc"
+  }
+}`
+
+	dataBagItemV3 = `{
+  "id": "web-01",
+  "environment": {
+    "encrypted_data": "BlVDj2rvv/AIgcOy9frtxj6VxjSSO+yicVRIc2E=\n",
+    "iv": "AQIDBAUGBwgJCgsM\n",
+    "auth_tag": "ouJ/N8/viwmPuBV1trxZpA==\n",
+    "version": 3,
+    "cipher": "aes-256-gcm"
+  },
+  "run_list": {
+    "encrypted_data": "fdXdti8iZ6LGc0G8Ev8PtzQreFEta6jT2jlscST9TQ+futuLafu9NAJ7Nlrr\nTw==\n",
+    "iv": "ZWZnaGlqa2xtbm9w\n",
+    "auth_tag": "MJ7bmmFSgD/y5VThpBJsxg==\n",
+    "version": 3,
+    "cipher": "aes-256-gcm"
+  }
+}`
+)
+
+func TestDecryptDataBagItem(t *testing.T) {
+	want := map[string]interface{}{
+		"id":          "web-01",
+		"environment": "production",
+		"run_list":    []interface{}{"role[web]", "recipe[nginx]"},
+	}
+
+	cases := []struct {
+		name   string
+		raw    string
+		secret string
+		want   map[string]interface{}
+		err    string
+	}{
+		{
+			name:   "version 1",
+			raw:    dataBagItemV1,
+			secret: dataBagTestSecret,
+			want:   want,
+		},
+		{
+			name:   "version 2",
+			raw:    dataBagItemV2,
+			secret: dataBagTestSecret,
+			want:   want,
+		},
+		{
+			name:   "version 3",
+			raw:    dataBagItemV3,
+			secret: dataBagTestSecret,
+			want:   want,
+		},
+		{
+			name:   "not encrypted",
+			raw:    `{"id": "web-01", "environment": "production", "app": {"version": 2}}`,
+			secret: dataBagTestSecret,
+			want: map[string]interface{}{
+				"id":          "web-01",
+				"environment": "production",
+				"app":         map[string]interface{}{"version": float64(2)},
+			},
+		},
+		{
+			name: "no secret",
+			raw:  dataBagItemV3,
+			err:  "no data_bag_secret is configured",
+		},
+		{
+			name:   "version 2 wrong secret",
+			raw:    dataBagItemV2,
+			secret: "wrong secret",
+			err:    "hmac does not match",
+		},
+		{
+			name:   "version 3 wrong secret",
+			raw:    dataBagItemV3,
+			secret: "wrong secret",
+			err:    "authentication failed",
+		},
+		{
+			name:   "wrong hmac",
+			raw:    strings.Replace(dataBagItemV2, "uGX/39LOEYU36f8mySQUuNVJrw3k/q6PYZGgqby02dU=", "3OxLVDjFt0NqYeka1fTIrQ87EhBkNsPcbjAIElEQwLQ=", 1),
+			secret: dataBagTestSecret,
+			err:    "hmac does not match",
+		},
+		{
+			name:   "tampered version 2 data",
+			raw:    strings.Replace(dataBagItemV2, "ECxuIinxYKh/", "ECxuIinxYKh+", 1),
+			secret: dataBagTestSecret,
+			err:    "hmac does not match",
+		},
+		{
+			name:   "wrong auth tag",
+			raw:    strings.Replace(dataBagItemV3, "ouJ/N8/viwmPuBV1trxZpA==", "MJ7bmmFSgD/y5VThpBJsxg==", 1),
+			secret: dataBagTestSecret,
+			err:    "authentication failed",
+		},
+		{
+			name:   "short auth tag",
+			raw:    strings.Replace(dataBagItemV3, "ouJ/N8/viwmPuBV1trxZpA==", "ouJ/N8/viwmPuBV1", 1),
+			secret: dataBagTestSecret,
+			err:    "bad auth_tag length",
+		},
+		{
+			// A full block whose last byte is not a PKCS#7 pad
+			name:   "bad padding",
+			raw:    strings.Replace(dataBagItemV1, "ECxuIinxYKh/ttZ4AlMsmLNw2yeNSETC1t7z9g+/pb0=", "ECxuIinxYKh/ttZ4AlMsmPIGmAg9eWAflPT1EpFo/Ak=", 1),
+			secret: dataBagTestSecret,
+			err:    "bad padding",
+		},
+		{
+			name:   "truncated data",
+			raw:    strings.Replace(dataBagItemV1, "ECxuIinxYKh/ttZ4AlMsmLNw2yeNSETC1t7z9g+/pb0=", "ECxuIinxYKh/ttZ4AlMs", 1),
+			secret: dataBagTestSecret,
+			err:    "bad encrypted data length",
+		},
+		{
+			name:   "missing encrypted_data",
+			raw:    `{"id": "web-01", "environment": {"iv": "AQIDBAUGBwgJCgsM\n", "auth_tag": "ouJ/N8/viwmPuBV1trxZpA==\n", "version": 3, "cipher": "aes-256-gcm"}}`,
+			secret: dataBagTestSecret,
+			err:    "missing encrypted_data",
+		},
+		{
+			name:   "missing iv",
+			raw:    `{"id": "web-01", "environment": {"encrypted_data": "BlVDj2rvv/AIgcOy9frtxj6VxjSSO+yicVRIc2E=\n", "auth_tag": "ouJ/N8/viwmPuBV1trxZpA==\n", "version": 3, "cipher": "aes-256-gcm"}}`,
+			secret: dataBagTestSecret,
+			err:    "missing iv",
+		},
+		{
+			name:   "bad base64",
+			raw:    strings.Replace(dataBagItemV1, "ECxuIinxYKh/", "ECxuIinxYKh!", 1),
+			secret: dataBagTestSecret,
+			err:    "bad encrypted_data",
+		},
+		{
+			name:   "unsupported version",
+			raw:    strings.Replace(dataBagItemV3, `"version": 3`, `"version": 4`, 1),
+			secret: dataBagTestSecret,
+			err:    "unsupported encrypted data bag version 4",
+		},
+		{
+			name:   "unsupported cipher",
+			raw:    strings.Replace(dataBagItemV1, `"cipher": "aes-256-cbc"`, `"cipher": "aes-128-cbc"`, 1),
+			secret: dataBagTestSecret,
+			err:    "unsupported cipher",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := decryptDataBagItem([]byte(tc.raw), tc.secret)
+			if tc.err != "" {
+				if err == nil {
+					t.Fatalf("expected an error containing %q", tc.err)
+				}
+				if !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected an error containing %q, got %s", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var item map[string]interface{}
+			if err := json.Unmarshal(got, &item); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(item, tc.want) {
+				t.Fatalf("expected %v, got %v", tc.want, item)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package chefclient
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/pkg/errors"
+	"github.com/tidwall/gjson"
+)
+
+const (
+	// aliasSourceClientName names identity aliases after the Chef client.
+	aliasSourceClientName = "client_name"
+	// aliasSourceNodeName names identity aliases after the Chef node.
+	aliasSourceNodeName = "node_name"
+	// aliasSourceAttribute names identity aliases after a node attribute.
+	aliasSourceAttribute = "attribute"
+)
+
+// aliasName returns the name of the client's identity alias according to
+// the configured source.
+func aliasName(config *config, client string, node *chefNode) (string, error) {
+	switch config.AliasSource {
+	case aliasSourceNodeName:
+		return node.Name, nil
+	case aliasSourceAttribute:
+		value := gjson.GetBytes(node.raw, config.AliasAttribute)
+		if value.Type != gjson.String && value.Type != gjson.Number || value.String() == "" {
+			return "", fmt.Errorf("node attribute %q is not set", config.AliasAttribute)
+		}
+		return value.String(), nil
+	default:
+		return client, nil
+	}
+}
+
+// groupAliases returns the identity group aliases of the client: one per
+// expanded role, one for the environment prefixed with "env:" and, if
+// enabled, one per tag prefixed with "tag:". Clients awaiting approval have
+// none.
+func groupAliases(config *config, creds *verifyResp) []*logical.Alias {
+	if creds.pending {
+		return nil
+	}
+
+	names := newStringSet(creds.roles...)
+	if creds.node.Environment != "" {
+		names.add("env:" + creds.node.Environment)
+	}
+	if config.GroupAliasTags {
+		for _, tag := range creds.tags {
+			names.add("tag:" + tag)
+		}
+	}
+
+	aliases := make([]*logical.Alias, 0, len(names.items))
+	for _, name := range names.list() {
+		aliases = append(aliases, &logical.Alias{
+			Name: name,
+		})
+	}
+	return aliases
+}
+
+// renewIdentity updates the identity of a token being renewed. The token
+// cannot move to another entity, tokens issued before aliases were returned
+// take the current one. The group memberships are refreshed, the node's
+// roles may have changed.
+func (b *backend) renewIdentity(config *config, client string, auth *logical.Auth, creds *verifyResp) error {
+	if alias, ok := auth.InternalData["alias"].(string); ok && alias != creds.alias {
+		b.logger.Warn(fmt.Sprintf("Client %s identity alias changed from %s to %s", client, alias, creds.alias))
+		return errors.New("identity alias no longer matches")
+	}
+	auth.InternalData["alias"] = creds.alias
+	auth.Alias = &logical.Alias{
+		Name: creds.alias,
+	}
+
+	auth.GroupAliases = groupAliases(config, creds)
+	return nil
+}
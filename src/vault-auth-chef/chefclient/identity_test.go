@@ -0,0 +1,110 @@
+package chefclient
+
+import (
+	"testing"
+
+	"github.com/go-chef/chef"
+	log "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestRenewIdentityAlias(t *testing.T) {
+	b := &backend{logger: log.NewNullLogger()}
+	config := &config{}
+	creds := &verifyResp{node: &chefNode{Node: chef.Node{Name: "web-01"}}, alias: "web-01.example.com"}
+
+	cases := []struct {
+		name  string
+		alias interface{}
+		ok    bool
+	}{
+		{"same alias", "web-01.example.com", true},
+		{"changed alias", "web-02.example.com", false},
+		{"issued before aliases", nil, true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			auth := &logical.Auth{InternalData: map[string]interface{}{"chef_client": "web-01"}}
+			if tc.alias != nil {
+				auth.InternalData["alias"] = tc.alias
+			}
+
+			err := b.renewIdentity(config, "web-01", auth, creds)
+			if !tc.ok {
+				if err == nil {
+					t.Fatal("expected a changed alias to be refused")
+				}
+				if auth.Alias != nil || auth.InternalData["alias"] != tc.alias {
+					t.Fatalf("expected the token identity to be left unchanged, got %v", auth.Alias)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if auth.Alias == nil || auth.Alias.Name != creds.alias || auth.InternalData["alias"] != creds.alias {
+				t.Fatalf("expected alias %s, got %v", creds.alias, auth.Alias)
+			}
+		})
+	}
+}
+
+func TestRenewIdentityGroupAliases(t *testing.T) {
+	b := &backend{logger: log.NewNullLogger()}
+	node := &chefNode{Node: chef.Node{Name: "web-01", Environment: "production"}}
+
+	cases := []struct {
+		name  string
+		tags  bool
+		creds *verifyResp
+		want  []string
+	}{
+		{
+			name:  "roles and environment",
+			creds: &verifyResp{node: node, roles: []string{"web", "base"}, tags: []string{"frontend"}},
+			want:  []string{"web", "base", "env:production"},
+		},
+		{
+			name:  "tags",
+			tags:  true,
+			creds: &verifyResp{node: node, roles: []string{"web"}, tags: []string{"frontend"}},
+			want:  []string{"web", "env:production", "tag:frontend"},
+		},
+		{
+			name:  "roles removed",
+			creds: &verifyResp{node: node},
+			want:  []string{"env:production"},
+		},
+		{
+			name:  "pending",
+			creds: &verifyResp{node: node, roles: []string{"web"}, pending: true},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// The token was issued with other groups
+			auth := &logical.Auth{
+				InternalData: map[string]interface{}{},
+				GroupAliases: []*logical.Alias{{Name: "db"}, {Name: "env:staging"}},
+			}
+			if err := b.renewIdentity(&config{GroupAliasTags: tc.tags}, "web-01", auth, tc.creds); err != nil {
+				t.Fatal(err)
+			}
+
+			got := make([]string, 0, len(auth.GroupAliases))
+			for _, alias := range auth.GroupAliases {
+				got = append(got, alias.Name)
+			}
+			if len(got) != len(tc.want) {
+				t.Fatalf("expected group aliases %v, got %v", tc.want, got)
+			}
+			for i := range got {
+				if got[i] != tc.want[i] {
+					t.Fatalf("expected group aliases %v, got %v", tc.want, got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package chefclient
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/pkg/errors"
+	"github.com/tidwall/gjson"
+)
+
+// identitiesPrefix is the storage prefix of machine identity bindings.
+const identitiesPrefix = "identities/"
+
+const (
+	// machineIdentitySourceNode fingerprints attributes of the node object.
+	machineIdentitySourceNode = "node"
+	// machineIdentitySourceLogin fingerprints the machine_id login field.
+	machineIdentitySourceLogin = "login"
+)
+
+// defaultMachineIdentityAttributes are the Ohai attributes fingerprinted
+// when none are configured.
+var defaultMachineIdentityAttributes = []string{"automatic.dmi.system.uuid", "automatic.machine_id"}
+
+// identityEntry binds a client to the fingerprint of the machine it first
+// logged in from.
+type identityEntry struct {
+	Source      string    `json:"source"`
+	Attributes  []string  `json:"attributes"`
+	Fingerprint string    `json:"fingerprint"`
+	BoundAt     time.Time `json:"bound_at"`
+}
+
+// machineFingerprint hashes the values of the attributes of the node. It
+// fails when none of them is set, as the machine cannot be told apart.
+func machineFingerprint(node *chefNode, attributes []string) (string, error) {
+	h := sha256.New()
+	set := false
+	for _, attr := range attributes {
+		value := gjson.GetBytes(node.raw, attr).String()
+		if value != "" {
+			set = true
+		}
+		fmt.Fprintf(h, "%s=%s\n", attr, value)
+	}
+	if !set {
+		return "", fmt.Errorf("none of the machine identity attributes of node %s are set", node.Name)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// loginFingerprint hashes the machine_id given at login.
+func loginFingerprint(machineID string) (string, error) {
+	if machineID == "" {
+		return "", errors.New("login has no machine_id")
+	}
+	sum := sha256.Sum256([]byte("machine_id=" + machineID + "\n"))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// fingerprint computes the fingerprint of the machine from the source the
+// binding uses. Bindings made before sources existed have no source and use
+// the node.
+func (e *identityEntry) fingerprint(node *chefNode, machineID string) (string, error) {
+	if e.Source == machineIdentitySourceLogin {
+		return loginFingerprint(machineID)
+	}
+	return machineFingerprint(node, e.Attributes)
+}
+
+// Identity returns the machine identity binding of the client, or nil if
+// it has none.
+func (b *backend) Identity(ctx context.Context, s logical.Storage, client string) (*identityEntry, error) {
+	entry, err := s.Get(ctx, identitiesPrefix+client)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get identity from storage")
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var result identityEntry
+	if err := entry.DecodeJSON(&result); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode identity")
+	}
+	return &result, nil
+}
+
+// checkMachineIdentity binds the client to the machine fingerprint on its
+// first login and refuses later logins from another machine. The stored
+// source and attributes are fingerprinted, so changing the configured ones
+// only affects new bindings.
+func (b *backend) checkMachineIdentity(ctx context.Context, s logical.Storage, config *config, client string, node *chefNode, machineID string) error {
+	if !config.MachineIdentity {
+		return nil
+	}
+
+	b.identityLock.Lock()
+	defer b.identityLock.Unlock()
+
+	identity, err := b.Identity(ctx, s, client)
+	if err != nil {
+		return err
+	}
+
+	if identity != nil {
+		fingerprint, err := identity.fingerprint(node, machineID)
+		if err != nil {
+			return err
+		}
+		if subtle.ConstantTimeCompare([]byte(fingerprint), []byte(identity.Fingerprint)) != 1 {
+			return fmt.Errorf("machine identity does not match the one bound at %s", identity.BoundAt.Format(time.RFC3339))
+		}
+		return nil
+	}
+
+	identity = &identityEntry{
+		Source:  config.MachineIdentitySource,
+		BoundAt: time.Now().UTC(),
+	}
+	if identity.Source != machineIdentitySourceLogin {
+		identity.Attributes = config.MachineIdentityAttributes
+	}
+	if identity.Fingerprint, err = identity.fingerprint(node, machineID); err != nil {
+		return err
+	}
+	entry, err := logical.StorageEntryJSON(identitiesPrefix+client, identity)
+	if err != nil {
+		return errors.Wrapf(err, "failed to generate storage entry")
+	}
+	if err := s.Put(ctx, entry); err != nil {
+		return errors.Wrapf(err, "failed to write identity to storage")
+	}
+	b.logger.Info(fmt.Sprintf("Client %s bound to machine identity %s", client, identity.Fingerprint))
+	return nil
+}
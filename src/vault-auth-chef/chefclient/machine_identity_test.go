@@ -0,0 +1,116 @@
+package chefclient
+
+import (
+	"context"
+	"testing"
+
+	log "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestCheckMachineIdentity(t *testing.T) {
+	node := func(uuid string) *chefNode {
+		return &chefNode{raw: []byte(`{"automatic": {"dmi": {"system": {"uuid": "` + uuid + `"}}}}`)}
+	}
+
+	type login struct {
+		node      *chefNode
+		machineID string
+		ok        bool
+	}
+	cases := []struct {
+		name   string
+		source string
+		logins []login
+	}{
+		{
+			name:   "node same machine",
+			source: machineIdentitySourceNode,
+			logins: []login{{node("a"), "", true}, {node("a"), "x", true}},
+		},
+		{
+			name:   "node other machine",
+			source: machineIdentitySourceNode,
+			logins: []login{{node("a"), "", true}, {node("b"), "", false}},
+		},
+		{
+			name:   "node attributes not set",
+			source: machineIdentitySourceNode,
+			logins: []login{{node(""), "", false}},
+		},
+		{
+			name:   "login same machine id",
+			source: machineIdentitySourceLogin,
+			logins: []login{{node("a"), "m1", true}, {node("b"), "m1", true}},
+		},
+		{
+			// The node object can be rewritten by whoever holds the key
+			name:   "login other machine id",
+			source: machineIdentitySourceLogin,
+			logins: []login{{node("a"), "m1", true}, {node("a"), "m2", false}},
+		},
+		{
+			name:   "login without machine id",
+			source: machineIdentitySourceLogin,
+			logins: []login{{node("a"), "", false}},
+		},
+		{
+			name:   "login machine id dropped after binding",
+			source: machineIdentitySourceLogin,
+			logins: []login{{node("a"), "m1", true}, {node("a"), "", false}},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			s := &logical.InmemStorage{}
+			b := &backend{logger: log.NewNullLogger()}
+			config := &config{
+				MachineIdentity:           true,
+				MachineIdentitySource:     tc.source,
+				MachineIdentityAttributes: []string{"automatic.dmi.system.uuid"},
+			}
+
+			for i, l := range tc.logins {
+				err := b.checkMachineIdentity(ctx, s, config, "web-01", l.node, l.machineID)
+				if l.ok && err != nil {
+					t.Fatalf("login %d: expected no error, got %s", i, err)
+				}
+				if !l.ok && err == nil {
+					t.Fatalf("login %d: expected an error", i)
+				}
+			}
+		})
+	}
+}
+
+// TestCheckMachineIdentitySourceChange checks bindings keep the source they
+// were made with.
+func TestCheckMachineIdentitySourceChange(t *testing.T) {
+	ctx := context.Background()
+	s := &logical.InmemStorage{}
+	b := &backend{logger: log.NewNullLogger()}
+	node := &chefNode{raw: []byte(`{"automatic": {"machine_id": "a"}}`)}
+	config := &config{
+		MachineIdentity:           true,
+		MachineIdentitySource:     machineIdentitySourceNode,
+		MachineIdentityAttributes: []string{"automatic.machine_id"},
+	}
+
+	if err := b.checkMachineIdentity(ctx, s, config, "web-01", node, ""); err != nil {
+		t.Fatal(err)
+	}
+	config.MachineIdentitySource = machineIdentitySourceLogin
+	if err := b.checkMachineIdentity(ctx, s, config, "web-01", node, ""); err != nil {
+		t.Fatalf("expected the node binding to be kept, got %s", err)
+	}
+
+	identity, err := b.Identity(ctx, s, "web-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Source != machineIdentitySourceNode {
+		t.Fatalf("expected source %q, got %q", machineIdentitySourceNode, identity.Source)
+	}
+}
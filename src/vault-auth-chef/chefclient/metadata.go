@@ -0,0 +1,109 @@
+package chefclient
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+const (
+	// maxTokenMetadataKeys is the maximum number of token_metadata entries.
+	maxTokenMetadataKeys = 32
+	// maxTokenMetadataValue is the length token metadata values are cut to.
+	maxTokenMetadataValue = 512
+
+	// dataBagPathPrefix marks token_metadata paths in the data bag item.
+	dataBagPathPrefix = "data_bag."
+)
+
+// tokenMetadataKeyRe matches valid token_metadata keys.
+var tokenMetadataKeyRe = regexp.MustCompile(`^[a-z0-9_]{1,64}$`)
+
+// reservedMetadata are the token metadata keys set by the plugin itself.
+var reservedMetadata = []string{
+	"chef_node_name", "chef_node_environment", "chef_node_policy_name",
+	"chef_node_policy_group", "chef_node_roles", "chef_node_recipes", "role",
+}
+
+// reservedMetadataPrefixes are the prefixes of the token metadata keys set
+// by the plugin: the node ones and the data_bag_fields.
+var reservedMetadataPrefixes = []string{"chef_node_", "chef_data_"}
+
+// validateTokenMetadata checks the token_metadata mapping.
+func validateTokenMetadata(metadata map[string]string) error {
+	if len(metadata) > maxTokenMetadataKeys {
+		return fmt.Errorf("at most %d keys are allowed", maxTokenMetadataKeys)
+	}
+	for key, path := range metadata {
+		if err := validateTokenMetadataKey(key); err != nil {
+			return err
+		}
+		if path == "" || path == dataBagPathPrefix {
+			return fmt.Errorf("key %q has no path", key)
+		}
+	}
+	return nil
+}
+
+// validateTokenMetadataKey checks the key is valid and does not shadow the
+// metadata set by the plugin.
+func validateTokenMetadataKey(key string) error {
+	if strings.HasPrefix(key, dataBagPathPrefix) {
+		return fmt.Errorf("key %q cannot start with %q, which marks data bag paths", key, dataBagPathPrefix)
+	}
+	if !tokenMetadataKeyRe.MatchString(key) {
+		return fmt.Errorf("key %q must be at most 64 lowercase letters, digits and underscores", key)
+	}
+	for _, reserved := range reservedMetadata {
+		if key == reserved {
+			return fmt.Errorf("key %q is reserved", key)
+		}
+	}
+	for _, prefix := range reservedMetadataPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return fmt.Errorf("key %q is reserved, keys cannot start with %q", key, prefix)
+		}
+	}
+	return nil
+}
+
+// tokenMetadata reads the configured token metadata from the node object, or
+// from the data bag item for paths starting with "data_bag.". Lists are
+// joined with commas and missing attributes are left out.
+func (b *backend) tokenMetadata(config *config, node *chefNode, dataBag []byte) map[string]string {
+	metadata := make(map[string]string, len(config.TokenMetadata))
+	for key, path := range config.TokenMetadata {
+		// Configurations written before the reserved prefixes were refused
+		if err := validateTokenMetadataKey(key); err != nil {
+			b.logger.Warn(fmt.Sprintf("Ignoring token metadata: %s", err))
+			continue
+		}
+
+		doc := node.raw
+		if strings.HasPrefix(path, dataBagPathPrefix) {
+			doc, path = dataBag, strings.TrimPrefix(path, dataBagPathPrefix)
+		}
+
+		value := gjson.GetBytes(doc, path)
+		if !value.Exists() || value.Type == gjson.Null {
+			continue
+		}
+
+		s := value.String()
+		if value.IsArray() {
+			items := make([]string, 0)
+			for _, item := range value.Array() {
+				items = append(items, item.String())
+			}
+			s = strings.Join(items, ",")
+		}
+		if len(s) > maxTokenMetadataValue {
+			b.logger.Warn(fmt.Sprintf("Token metadata %s of node %s truncated to %d bytes", key, node.Name, maxTokenMetadataValue))
+			s = s[:maxTokenMetadataValue]
+		}
+		metadata[key] = s
+	}
+	return metadata
+}
@@ -0,0 +1,79 @@
+package chefclient
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	log "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestValidateTokenMetadata(t *testing.T) {
+	cases := []struct {
+		key  string
+		path string
+		ok   bool
+	}{
+		{"platform", "automatic.platform", true},
+		{"owner", "data_bag.owner", true},
+		{"chef_platform", "automatic.platform", true},
+		{"node_name", "name", true},
+
+		{"chef_node_name", "name", false},
+		{"chef_node_environment", "chef_environment", false},
+		{"chef_node_roles", "automatic.roles", false},
+		{"chef_node_fqdn", "automatic.fqdn", false},
+		{"chef_data_owner", "data_bag.owner", false},
+		{"role", "normal.role", false},
+		{"data_bag.owner", "data_bag.owner", false},
+		{"data_bag.", "automatic.platform", false},
+		{"Platform", "automatic.platform", false},
+		{"platform", "", false},
+		{"platform", "data_bag.", false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.key+"="+tc.path, func(t *testing.T) {
+			err := validateTokenMetadata(map[string]string{tc.key: tc.path})
+			if tc.ok && err != nil {
+				t.Fatalf("expected no error, got %s", err)
+			}
+			if !tc.ok && err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+// TestConfigTokenMetadataReserved checks config writes refuse token_metadata
+// keys shadowing the metadata set by the plugin.
+func TestConfigTokenMetadataReserved(t *testing.T) {
+	ctx := context.Background()
+	b := Backend(&logical.BackendConfig{Logger: log.NewNullLogger()})
+
+	for _, metadata := range []string{"chef_node_name=automatic.fqdn", "chef_node_environment=normal.env", "data_bag.owner=data_bag.owner", "chef_data_owner=normal.owner"} {
+		t.Run(metadata, func(t *testing.T) {
+			s := &logical.InmemStorage{}
+			resp, err := b.HandleRequest(ctx, &logical.Request{
+				Operation: logical.UpdateOperation,
+				Path:      "config",
+				Storage:   s,
+				Data: map[string]interface{}{
+					"chef_server":    "https://chef.example.com/organizations/example/",
+					"run_list_src":   "node",
+					"token_metadata": metadata,
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp == nil || !resp.IsError() || !strings.Contains(resp.Error().Error(), "'token_metadata'") {
+				t.Fatalf("expected a bad token_metadata error, got %#v", resp)
+			}
+			if entry, err := s.Get(ctx, "config"); err != nil || entry != nil {
+				t.Fatalf("expected no config written, got %v, %v", entry, err)
+			}
+		})
+	}
+}
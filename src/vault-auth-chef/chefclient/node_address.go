@@ -0,0 +1,150 @@
+package chefclient
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/pkg/errors"
+	"github.com/tidwall/gjson"
+)
+
+// remoteAddr returns the address of the client logging in. When the request
+// comes from a trusted proxy, the proxy header is read right to left and the
+// first address which is not a trusted proxy is returned.
+func remoteAddr(config *config, req *logical.Request) net.IP {
+	if req.Connection == nil {
+		return nil
+	}
+	addr := net.ParseIP(req.Connection.RemoteAddr)
+	if addr == nil || config.RemoteAddrHeader == "" || !addrInCIDRs(addr, config.TrustedProxies) {
+		return addr
+	}
+
+	hops := make([]string, 0)
+	for name, values := range req.Headers {
+		if !strings.EqualFold(name, config.RemoteAddrHeader) {
+			continue
+		}
+		for _, value := range values {
+			hops = append(hops, strings.Split(value, ",")...)
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			return nil
+		}
+		addr = hop
+		if !addrInCIDRs(addr, config.TrustedProxies) {
+			break
+		}
+	}
+	return addr
+}
+
+// nodeAddresses returns the addresses Ohai reported for the node: ipaddress,
+// ip6address and the addresses of every network interface but loopbacks.
+func nodeAddresses(raw []byte) []net.IP {
+	addrs := make([]net.IP, 0)
+	add := func(value string) {
+		if addr := net.ParseIP(value); addr != nil && !addr.IsLoopback() {
+			addrs = append(addrs, addr)
+		}
+	}
+
+	add(gjson.GetBytes(raw, "automatic.ipaddress").String())
+	add(gjson.GetBytes(raw, "automatic.ip6address").String())
+	gjson.GetBytes(raw, "automatic.network.interfaces").ForEach(func(_, iface gjson.Result) bool {
+		iface.Get("addresses").ForEach(func(addr, info gjson.Result) bool {
+			family := info.Get("family").String()
+			if family == "inet" || family == "inet6" {
+				add(strings.SplitN(addr.String(), "%", 2)[0])
+			}
+			return true
+		})
+		return true
+	})
+	return addrs
+}
+
+// dataBagAddresses returns the addresses at path in the client's data bag
+// item, either a single address or a list of them.
+func dataBagAddresses(raw []byte, path string) []net.IP {
+	addrs := make([]net.IP, 0)
+	value := gjson.GetBytes(raw, path)
+	values := []gjson.Result{value}
+	if value.IsArray() {
+		values = value.Array()
+	}
+	for _, v := range values {
+		if addr := net.ParseIP(v.String()); addr != nil {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// nodeAddressMatch returns the network of addr with the configured prefix
+// lengths if it holds one of the node addresses, or nil if none.
+func nodeAddressMatch(config *config, addr net.IP, nodeAddrs []net.IP) *net.IPNet {
+	bits, prefix := 128, config.NodeAddress6Prefix
+	if addr.To4() != nil {
+		bits, prefix = 32, config.NodeAddressPrefix
+	}
+	if prefix == 0 {
+		prefix = bits
+	}
+
+	mask := net.CIDRMask(prefix, bits)
+	for _, nodeAddr := range nodeAddrs {
+		if (addr.To4() != nil) != (nodeAddr.To4() != nil) {
+			continue
+		}
+		if addr.Mask(mask).Equal(nodeAddr.Mask(mask)) {
+			return &net.IPNet{IP: addr.Mask(mask), Mask: mask}
+		}
+	}
+	return nil
+}
+
+// checkRemoteAddr checks the client logs in from within the bound CIDRs and,
+// if enabled, from one of the node's addresses, which the token is then
+// bound to as well.
+func checkRemoteAddr(config *config, req *logical.Request, creds *verifyResp) error {
+	if len(creds.boundCIDRs) == 0 && !config.BindNodeAddress {
+		return nil
+	}
+
+	addr := remoteAddr(config, req)
+	if addr == nil {
+		return errors.New("the client address is unknown")
+	}
+	if len(creds.boundCIDRs) > 0 && !addrInCIDRs(addr, creds.boundCIDRs) {
+		return fmt.Errorf("address %s is outside of the bound CIDRs", addr)
+	}
+	if !config.BindNodeAddress {
+		return nil
+	}
+
+	// Addresses read from the data bag cannot be rewritten by the node
+	nodeAddrs := nodeAddresses(creds.node.raw)
+	if config.NodeAddressDataBagPath != "" {
+		if creds.dataBag == nil {
+			return fmt.Errorf("node %s has no data bag item to read its addresses from", creds.node.Name)
+		}
+		nodeAddrs = dataBagAddresses(creds.dataBag, config.NodeAddressDataBagPath)
+	}
+
+	network := nodeAddressMatch(config, addr, nodeAddrs)
+	if network == nil {
+		return fmt.Errorf("address %s is not an address of node %s", addr, creds.node.Name)
+	}
+	if len(creds.boundCIDRs) == 0 {
+		creds.boundCIDRs = []string{network.String()}
+	} else {
+		creds.boundCIDRs = intersectCIDRs(creds.boundCIDRs, []string{network.String()})
+	}
+	return nil
+}
@@ -0,0 +1,251 @@
+package chefclient
+
+import (
+	"net"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestRemoteAddr(t *testing.T) {
+	proxied := &config{
+		RemoteAddrHeader: "X-Forwarded-For",
+		TrustedProxies:   []string{"10.0.0.0/24"},
+	}
+
+	cases := []struct {
+		name    string
+		config  *config
+		conn    *logical.Connection
+		headers map[string][]string
+		want    string
+	}{
+		{
+			name:   "no connection",
+			config: &config{},
+			want:   "",
+		},
+		{
+			name:   "direct",
+			config: &config{},
+			conn:   &logical.Connection{RemoteAddr: "192.0.2.1"},
+			want:   "192.0.2.1",
+		},
+		{
+			name:   "bad remote address",
+			config: &config{},
+			conn:   &logical.Connection{RemoteAddr: "not-an-address"},
+			want:   "",
+		},
+		{
+			name:    "header ignored without trusted proxies",
+			config:  &config{RemoteAddrHeader: "X-Forwarded-For"},
+			conn:    &logical.Connection{RemoteAddr: "192.0.2.1"},
+			headers: map[string][]string{"X-Forwarded-For": {"198.51.100.7"}},
+			want:    "192.0.2.1",
+		},
+		{
+			name:    "header ignored from untrusted peer",
+			config:  proxied,
+			conn:    &logical.Connection{RemoteAddr: "192.0.2.1"},
+			headers: map[string][]string{"X-Forwarded-For": {"198.51.100.7"}},
+			want:    "192.0.2.1",
+		},
+		{
+			name:   "trusted proxy without header",
+			config: proxied,
+			conn:   &logical.Connection{RemoteAddr: "10.0.0.1"},
+			want:   "10.0.0.1",
+		},
+		{
+			name:    "trusted proxy",
+			config:  proxied,
+			conn:    &logical.Connection{RemoteAddr: "10.0.0.1"},
+			headers: map[string][]string{"X-Forwarded-For": {"198.51.100.7"}},
+			want:    "198.51.100.7",
+		},
+		{
+			name:    "header name is case insensitive",
+			config:  proxied,
+			conn:    &logical.Connection{RemoteAddr: "10.0.0.1"},
+			headers: map[string][]string{"x-forwarded-for": {"198.51.100.7"}},
+			want:    "198.51.100.7",
+		},
+		{
+			name:    "chained trusted proxies are skipped",
+			config:  proxied,
+			conn:    &logical.Connection{RemoteAddr: "10.0.0.1"},
+			headers: map[string][]string{"X-Forwarded-For": {"198.51.100.7, 10.0.0.2"}},
+			want:    "198.51.100.7",
+		},
+		{
+			name:    "spoofed hops left of the client are ignored",
+			config:  proxied,
+			conn:    &logical.Connection{RemoteAddr: "10.0.0.1"},
+			headers: map[string][]string{"X-Forwarded-For": {"203.0.113.9, 198.51.100.7"}},
+			want:    "198.51.100.7",
+		},
+		{
+			name:    "repeated headers are read in order",
+			config:  proxied,
+			conn:    &logical.Connection{RemoteAddr: "10.0.0.1"},
+			headers: map[string][]string{"X-Forwarded-For": {"203.0.113.9", "198.51.100.7"}},
+			want:    "198.51.100.7",
+		},
+		{
+			name:    "malformed hop",
+			config:  proxied,
+			conn:    &logical.Connection{RemoteAddr: "10.0.0.1"},
+			headers: map[string][]string{"X-Forwarded-For": {"198.51.100.7, junk"}},
+			want:    "",
+		},
+		{
+			name:    "only trusted hops",
+			config:  proxied,
+			conn:    &logical.Connection{RemoteAddr: "10.0.0.1"},
+			headers: map[string][]string{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}},
+			want:    "10.0.0.3",
+		},
+		{
+			name:    "IPv6 client",
+			config:  proxied,
+			conn:    &logical.Connection{RemoteAddr: "10.0.0.1"},
+			headers: map[string][]string{"X-Forwarded-For": {"2001:db8::7"}},
+			want:    "2001:db8::7",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := &logical.Request{Connection: tc.conn, Headers: tc.headers}
+			got := remoteAddr(tc.config, req)
+			if tc.want == "" {
+				if got != nil {
+					t.Fatalf("expected no address, got %s", got)
+				}
+				return
+			}
+			if !got.Equal(net.ParseIP(tc.want)) {
+				t.Fatalf("expected %s, got %s", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestNodeAddressMatch(t *testing.T) {
+	nodeAddrs := []net.IP{
+		net.ParseIP("192.0.2.10"),
+		net.ParseIP("2001:db8:1::10"),
+	}
+
+	cases := []struct {
+		name     string
+		config   *config
+		addr     string
+		nodeAddr []net.IP
+		want     string
+	}{
+		{
+			name:   "exact IPv4",
+			config: &config{},
+			addr:   "192.0.2.10",
+			want:   "192.0.2.10/32",
+		},
+		{
+			name:   "other IPv4",
+			config: &config{},
+			addr:   "192.0.2.11",
+			want:   "",
+		},
+		{
+			name:   "IPv4 network",
+			config: &config{NodeAddressPrefix: 24},
+			addr:   "192.0.2.200",
+			want:   "192.0.2.0/24",
+		},
+		{
+			name:   "outside the IPv4 network",
+			config: &config{NodeAddressPrefix: 24},
+			addr:   "192.0.3.10",
+			want:   "",
+		},
+		{
+			name:   "exact IPv6",
+			config: &config{},
+			addr:   "2001:db8:1::10",
+			want:   "2001:db8:1::10/128",
+		},
+		{
+			name:   "IPv6 network",
+			config: &config{NodeAddress6Prefix: 64},
+			addr:   "2001:db8:1::ffff",
+			want:   "2001:db8:1::/64",
+		},
+		{
+			name:   "IPv4 prefix does not apply to IPv6",
+			config: &config{NodeAddressPrefix: 8},
+			addr:   "2001:db8:1::11",
+			want:   "",
+		},
+		{
+			name:     "families do not match",
+			config:   &config{NodeAddressPrefix: 1, NodeAddress6Prefix: 1},
+			addr:     "192.0.2.10",
+			nodeAddr: []net.IP{net.ParseIP("2001:db8:1::10")},
+			want:     "",
+		},
+		{
+			name:     "no node addresses",
+			config:   &config{},
+			addr:     "192.0.2.10",
+			nodeAddr: []net.IP{},
+			want:     "",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			addrs := nodeAddrs
+			if tc.nodeAddr != nil {
+				addrs = tc.nodeAddr
+			}
+			got := nodeAddressMatch(tc.config, net.ParseIP(tc.addr), addrs)
+			if tc.want == "" {
+				if got != nil {
+					t.Fatalf("expected no match, got %s", got)
+				}
+				return
+			}
+			if got == nil || got.String() != tc.want {
+				t.Fatalf("expected %s, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestDataBagAddresses(t *testing.T) {
+	cases := []struct {
+		name string
+		raw  string
+		path string
+		want []string
+	}{
+		{"single", `{"address": "192.0.2.10"}`, "address", []string{"192.0.2.10"}},
+		{"list", `{"net": {"addresses": ["192.0.2.10", "junk", "2001:db8::1"]}}`, "net.addresses", []string{"192.0.2.10", "2001:db8::1"}},
+		{"missing", `{"id": "web-01"}`, "address", []string{}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := dataBagAddresses([]byte(tc.raw), tc.path)
+			if len(got) != len(tc.want) {
+				t.Fatalf("expected %v, got %v", tc.want, got)
+			}
+			for i := range got {
+				if !got[i].Equal(net.ParseIP(tc.want[i])) {
+					t.Fatalf("expected %v, got %v", tc.want, got)
+				}
+			}
+		})
+	}
+}
@@ -2,33 +2,54 @@ package chefclient
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-	"regexp"
 	"strings"
 	"time"
 
 	"github.com/go-chef/chef"
-	"github.com/hashicorp/vault/helper/policyutil"
-	"github.com/hashicorp/vault/logical"
-	"github.com/hashicorp/vault/logical/framework"
+	"github.com/hashicorp/go-secure-stdlib/parseutil"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
 	"github.com/pkg/errors"
-	"github.com/tidwall/gjson"
 )
 
 // verifyResp is a wrapper around fields returned from verifyCreds.
 type verifyResp struct {
 	policies []string
-	node     *chef.Node
-
-	ttl    time.Duration
-	maxTTL time.Duration
+	node     *chefNode
+	role     string
+	roles    []string
+	recipes  []string
+	tags     []string
+	data     map[string]string
+	metadata map[string]string
+	alias    string
+
+	// pending is set for clients awaiting approval.
+	pending bool
+
+	// dataBag is the raw data bag item of the client, if any.
+	dataBag []byte
+
+	ttl            time.Duration
+	maxTTL         time.Duration
+	period         time.Duration
+	explicitMaxTTL time.Duration
+	numUses        int
+	boundCIDRs     []string
+
+	tokenType       string
+	noDefaultPolicy bool
 }
 
 // roleMapTemplates defines fields that can be templated in a role to policy mapping
 type roleMapTemplates struct {
-	env  string
-	name string
+	env         string
+	name        string
+	policyName  string
+	policyGroup string
+	tags        []string
+	data        map[string]string
 }
 
 // pathAuthLogin accepts a user's personal OAuth token and validates the user's
@@ -51,8 +72,26 @@ func (b *backend) pathAuthLogin(ctx context.Context, req *logical.Request, d *fr
 		return errMissingField("client"), nil
 	}
 
+	// The name ends up in Chef API paths and storage keys
+	if !clientNameRe.MatchString(client) {
+		return logical.ErrorResponse(fmt.Sprintf("Bad value for field 'client': invalid client name %q", client)), nil
+	}
+
+	role := d.Get("role").(string)
+
+	config, err := b.Config(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := b.loginClient(config, client, key)
+	if err != nil {
+		b.logger.Warn(fmt.Sprintf("Chef auth error while auth: %s", err.Error()))
+		return nil, logical.ErrPermissionDenied
+	}
+
 	// Verify the credentails
-	creds, err := b.verifyCreds(ctx, req, client, key)
+	creds, err := b.verifyCreds(ctx, req, config, c, client, role)
 	if err != nil {
 		if err, ok := err.(logical.HTTPCodedError); ok {
 			return nil, err
@@ -60,12 +99,71 @@ func (b *backend) pathAuthLogin(ctx context.Context, req *logical.Request, d *fr
 		return nil, logical.ErrPermissionDenied
 	}
 
+	// Run the checks made on logins only
+	if err := b.checkLogin(ctx, req, config, client, creds); err != nil {
+		b.logger.Warn(fmt.Sprintf("Client %s login refused: %s", client, err.Error()))
+		return nil, logical.ErrPermissionDenied
+	}
+
 	// Compose the response
-	return &logical.Response{
+	return b.loginResponse(config, creds, client)
+}
+
+// checkLogin runs the checks made on logins only, once the client is
+// verified: where the client logs in from and, if bound, from which machine.
+func (b *backend) checkLogin(ctx context.Context, req *logical.Request, config *config, client string, creds *verifyResp) error {
+	if err := checkRemoteAddr(config, req, creds); err != nil {
+		return err
+	}
+	machineID, _ := req.Data["machine_id"].(string)
+	return b.checkMachineIdentity(ctx, req.Storage, config, client, creds.node, machineID)
+}
+
+// loginClient checks the client key and returns the Chef API client used to
+// look the client up. With a service credential the key is matched against
+// the client's public keys and the lookups use the service client, otherwise
+// the lookups are made as the client itself.
+func (b *backend) loginClient(config *config, client, key string) (*chef.Client, error) {
+	if config.ServiceClient == "" {
+		return newChefClient(config, client, key)
+	}
+
+	c, err := serviceClient(config)
+	if err != nil {
+		return nil, err
+	}
+	pubKeys, err := clientPublicKeys(c, client)
+	if err != nil {
+		return nil, err
+	}
+	if !keyMatches(key, pubKeys) {
+		return nil, fmt.Errorf("key does not match any key of client %q", client)
+	}
+	return c, nil
+}
+
+// loginResponse composes the login response for verified credentials. No
+// client secret is kept with the token, renewals re-check the client with
+// the service credential, so tokens are only renewable when it is configured.
+// Batch tokens are never renewable.
+func (b *backend) loginResponse(config *config, creds *verifyResp, client string) (*logical.Response, error) {
+	renewable := config.ServiceClient != "" && creds.tokenType != tokenTypeBatch
+
+	period := creds.period
+	if period > 0 {
+		period = capDuration(period, creds.explicitMaxTTL)
+	}
+
+	boundCIDRs, err := parseutil.ParseAddrs(creds.boundCIDRs)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse bound CIDRs")
+	}
+
+	resp := &logical.Response{
 		Auth: &logical.Auth{
 			InternalData: map[string]interface{}{
-				"chef_key":    key,
 				"chef_client": client,
+				"alias":       creds.alias,
 			},
 			Policies: creds.policies,
 			Metadata: map[string]string{
@@ -73,12 +171,50 @@ func (b *backend) pathAuthLogin(ctx context.Context, req *logical.Request, d *fr
 				"chef_node_environment": creds.node.Environment,
 			},
 			DisplayName: creds.node.Name,
+			Alias: &logical.Alias{
+				Name: creds.alias,
+			},
+			GroupAliases: groupAliases(config, creds),
+			Period:       period,
+			NumUses:      creds.numUses,
+
+			ExplicitMaxTTL:  creds.explicitMaxTTL,
+			BoundCIDRs:      boundCIDRs,
+			TokenType:       logicalTokenType(creds.tokenType),
+			NoDefaultPolicy: creds.noDefaultPolicy,
+
 			LeaseOptions: logical.LeaseOptions{
-				TTL:       creds.ttl,
-				Renewable: true,
+				TTL:       capDuration(creds.ttl, creds.explicitMaxTTL),
+				Renewable: renewable,
 			},
 		},
-	}, nil
+	}
+	if creds.node.PolicyName != "" {
+		resp.Auth.Metadata["chef_node_policy_name"] = creds.node.PolicyName
+	}
+	if creds.node.PolicyGroup != "" {
+		resp.Auth.Metadata["chef_node_policy_group"] = creds.node.PolicyGroup
+	}
+	if len(creds.roles) > 0 {
+		resp.Auth.Metadata["chef_node_roles"] = strings.Join(creds.roles, ",")
+	}
+	if len(creds.recipes) > 0 {
+		resp.Auth.Metadata["chef_node_recipes"] = strings.Join(creds.recipes, ",")
+	}
+	for k, v := range creds.data {
+		resp.Auth.Metadata["chef_data_"+k] = v
+	}
+	for k, v := range creds.metadata {
+		resp.Auth.Metadata[k] = v
+	}
+	if creds.role != "" {
+		resp.Auth.InternalData["role"] = creds.role
+		resp.Auth.Metadata["role"] = creds.role
+	}
+	if config.ServiceClient == "" {
+		resp.AddWarning("Token is not renewable because no service_client is configured.")
+	}
+	return resp, nil
 }
 
 // pathAuthRenew is used to renew authentication.
@@ -88,16 +224,6 @@ func (b *backend) pathAuthRenew(ctx context.Context, req *logical.Request, d *fr
 		return nil, errors.New("request auth was nil")
 	}
 
-	// Grab the chef key
-	keyRaw, ok := req.Auth.InternalData["chef_key"]
-	if !ok {
-		return nil, errors.New("no internal token found in the store")
-	}
-	key, ok := keyRaw.(string)
-	if !ok {
-		return nil, errors.New("stored access token is not a string")
-	}
-
 	// Grab the chef client
 	clientRaw, ok := req.Auth.InternalData["chef_client"]
 	if !ok {
@@ -108,8 +234,34 @@ func (b *backend) pathAuthRenew(ctx context.Context, req *logical.Request, d *fr
 		return nil, errors.New("stored access token is not a string")
 	}
 
+	// Grab the login role, if any
+	role, _ := req.Auth.InternalData["role"].(string)
+
+	config, err := b.Config(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	// Tokens issued by older versions of the plugin carry the client key, keep
+	// renewing them with it until they expire. Others are verified with the
+	// service credential.
+	var c *chef.Client
+	if keyRaw, ok := req.Auth.InternalData["chef_key"]; ok {
+		key, ok := keyRaw.(string)
+		if !ok {
+			return nil, errors.New("stored access token is not a string")
+		}
+		c, err = b.loginClient(config, client, key)
+	} else {
+		c, err = serviceClient(config)
+	}
+	if err != nil {
+		b.logger.Warn(fmt.Sprintf("Chef auth error while renew: %s", err.Error()))
+		return nil, logical.ErrPermissionDenied
+	}
+
 	// Verify the credentails
-	creds, err := b.verifyCreds(ctx, req, client, key)
+	creds, err := b.verifyCreds(ctx, req, config, c, client, role)
 	if err != nil {
 		if err, ok := err.(logical.HTTPCodedError); ok {
 			return nil, err
@@ -117,71 +269,172 @@ func (b *backend) pathAuthRenew(ctx context.Context, req *logical.Request, d *fr
 		return nil, logical.ErrPermissionDenied
 	}
 
-	// Make sure the policies haven't changed. If they have, inform the user to
-	// re-authenticate.
-	if !policyutil.EquivalentPolicies(creds.policies, req.Auth.Policies) {
-		return nil, errors.New("policies no longer match")
+	// Make sure the policies haven't changed beyond what renew_policy_change
+	// tolerates. If they have, inform the user to re-authenticate.
+	warning, err := checkPolicyChange(config.RenewPolicyChange, req.Auth.Policies, creds.policies)
+	if err != nil {
+		b.logger.Warn(fmt.Sprintf("Client %s renewal refused: %s", client, err.Error()))
+		return nil, err
+	}
+	if warning != "" {
+		b.logger.Info(fmt.Sprintf("Client %s renewed: %s", client, warning))
 	}
 
-	// Extend the lease
-	return framework.LeaseExtend(creds.ttl, creds.maxTTL, b.System())(ctx, req, d)
-}
-
-// verifyCreds verifies the given credentials.
-func (b *backend) verifyCreds(ctx context.Context, req *logical.Request, client, key string) (*verifyResp, error) {
-	config, err := b.Config(ctx, req.Storage)
-	if err != nil {
+	if err := b.renewIdentity(config, client, req.Auth, creds); err != nil {
 		return nil, err
 	}
 
-	c, err := chef.NewClient(&chef.Config{
-		Name:    client,
-		Key:     key,
-		BaseURL: config.ChefServer,
-		SkipSSL: config.SkipTLS,
-	})
+	// Tokens cannot live past their explicit max TTL, whatever their period
+	maxTTL := creds.maxTTL
+	period := creds.period
+	if creds.explicitMaxTTL > 0 {
+		remaining := creds.explicitMaxTTL - time.Since(req.Auth.IssueTime)
+		if remaining <= 0 {
+			return nil, errors.New("past the explicit max TTL, cannot renew")
+		}
+		maxTTL = capDuration(maxTTL, creds.explicitMaxTTL)
+		if period > 0 {
+			period = capDuration(period, remaining)
+		}
+	}
 
-	if err != nil {
-		b.logger.Warn(fmt.Sprintf("Chef auth error while auth: %s", err.Error()))
-		return nil, errors.Wrap(err, "auth.test")
+	// Periodic tokens are renewed by the expiration manager for the period,
+	// others get their lease extended
+	var resp *logical.Response
+	if period > 0 {
+		req.Auth.Period = period
+		resp = &logical.Response{Auth: req.Auth}
+	} else {
+		resp, err = framework.LeaseExtend(creds.ttl, maxTTL, b.System())(ctx, req, d)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if warning != "" {
+		resp.AddWarning(warning)
 	}
+	return resp, nil
+}
 
-	nodeRoles := make([]string, 0)
+// verifyCreds looks up the given client with the Chef API client c and maps
+// it to policies, either through the mount wide mappings or through the
+// named login role, if any.
+func (b *backend) verifyCreds(ctx context.Context, req *logical.Request, config *config, c *chef.Client, client, roleName string) (*verifyResp, error) {
+	var role *roleEntry
+	if roleName != "" {
+		var err error
+		role, err = b.Role(ctx, req.Storage, roleName)
+		if err != nil {
+			return nil, err
+		}
+		if role == nil {
+			return nil, logical.CodedError(400, fmt.Sprintf("role %q not found", roleName))
+		}
+	}
 
 	// Get node and validate client key
-	node, err := c.Nodes.Get(client)
+	node, err := getNode(c, client)
 	if err != nil {
 		b.logger.Warn(fmt.Sprintf("Chef auth error while get nodes: %s", err.Error()))
 		return nil, errors.Wrap(err, "nodes.list")
 	}
 
-	switch config.RunListSrc {
-	case "data":
-		nodeData := make(map[string]string, 0)
-		nodeRoles, nodeData = getRolesFromData(config.DataBags, client, c, b)
-		if nodeData == nil {
-			b.logger.Warn(fmt.Sprintf("Chef auth error while geting data bags: %s", err.Error()))
-			return nil, errors.Wrap(err, "data_bags.list")
-		}
-		node.Name = nodeData["id"]
-		node.Environment = nodeData["env"]
-	case "node":
-		nodeRoles = getRolesFromNode(node, client, c, b)
+	// Discover the run_list from the configured sources
+	discovered, err := b.discoverRunList(config, c, client, node)
+	if err != nil {
+		b.logger.Warn(fmt.Sprintf("Chef auth error while discovering run_list: %s", err.Error()))
+		return nil, errors.Wrap(err, "run_list sources")
+	}
+	nodeRoles, nodeRecipes := discovered.roles, discovered.recipes
+	if discovered.name != "" {
+		node.Name = discovered.name
+	}
+	if discovered.env != "" {
+		node.Environment = discovered.env
+	}
+
+	// Refuse nodes which stopped converging, they may be decommissioned
+	if err := checkNodeStaleness(config, node, time.Now()); err != nil {
+		b.logger.Warn(fmt.Sprintf("Client %s refused as stale: %s", client, err.Error()))
+		return nil, errors.Wrap(err, "node staleness")
+	}
+
+	// Expand nested roles
+	nodeRoles, nodeRecipes, err = expandRunList(config.RunListExpansion, c, node, nodeRoles, nodeRecipes, b)
+	if err != nil {
+		b.logger.Warn(fmt.Sprintf("Chef auth error while expanding run_list: %s", err.Error()))
+		return nil, errors.Wrap(err, "run_list expansion")
 	}
 
 	var templates roleMapTemplates
 	templates.env = node.Environment
 	templates.name = node.Name
+	templates.policyName = node.PolicyName
+	templates.policyGroup = node.PolicyGroup
+	templates.tags = stringsAttribute(node.NormalAttributes, "tags")
+	templates.data = discovered.fields
+
+	// Name the identity alias of the client
+	alias, err := aliasName(config, client, node)
+	if err != nil {
+		b.logger.Warn(fmt.Sprintf("Chef auth error while naming identity alias: %s", err.Error()))
+		return nil, errors.Wrap(err, "identity alias")
+	}
+
+	// Read the configured token metadata
+	metadata := b.tokenMetadata(config, node, discovered.dataBag)
+
+	// Deny lists take precedence over every mapping
+	if err := b.checkDenied(ctx, req.Storage, client, node, nodeRoles); err != nil {
+		b.logger.Warn(fmt.Sprintf("Client %s refused: %s", client, err.Error()))
+		return nil, err
+	}
+
+	// Clients awaiting approval only get the bootstrap policies
+	approved, err := b.checkApproval(ctx, req, config, client, node, nodeRoles)
+	if err != nil {
+		b.logger.Warn(fmt.Sprintf("Client %s refused: %s", client, err.Error()))
+		return nil, err
+	}
+	if !approved {
+		creds, err := b.pendingCreds(config, node)
+		if err != nil {
+			b.logger.Warn(fmt.Sprintf("Client %s refused: %s", client, err.Error()))
+			return nil, err
+		}
+		creds.role = roleName
+		creds.metadata = metadata
+		creds.alias = alias
+		creds.dataBag = discovered.dataBag
+		return creds, nil
+	}
+
+	// Login roles replace the mount wide mappings
+	if role != nil {
+		creds, err := b.verifyRole(config, client, roleName, role, node, nodeRoles, templates)
+		if err != nil {
+			return nil, err
+		}
+		creds.roles = nodeRoles
+		creds.tags = templates.tags
+		creds.metadata = metadata
+		creds.alias = alias
+		creds.dataBag = discovered.dataBag
+		return creds, nil
+	}
+
+	// Token settings of the matched mappings, the most restrictive win
+	overrides := &tokenSettings{}
 
 	// Accumulate all policies
-	hostsPolicies, err := b.HostsMap.Policies(ctx, req.Storage, client)
+	hostsPolicies, err := mapPolicies(ctx, req.Storage, b.HostsMap, overrides, client)
 	if err != nil {
 		b.logger.Warn(fmt.Sprintf("error while accumulate hosts policies: %s", err.Error()))
 		return nil, errors.Wrap(err, "client policies")
 	}
 	hostsPolicies = dynamicRoleMap(b, templates, hostsPolicies)
 
-	rolesPolicies, err := b.RolesMap.Policies(ctx, req.Storage, nodeRoles...)
+	rolesPolicies, err := mapPolicies(ctx, req.Storage, b.RolesMap, overrides, nodeRoles...)
 	if err != nil {
 		b.logger.Warn(fmt.Sprintf("error while accumulate roles policies: %s", err.Error()))
 		return nil, errors.Wrap(err, "run_list policies")
@@ -189,9 +442,98 @@ func (b *backend) verifyCreds(ctx context.Context, req *logical.Request, client,
 	rolesPolicies = dynamicRoleMap(b, templates, rolesPolicies)
 	b.logger.Debug(fmt.Sprintf("Client %s role %s policy: %s", client, strings.Join(nodeRoles, ","), strings.Join(rolesPolicies, ",")))
 
-	policies := make([]string, 0, len(hostsPolicies)+len(rolesPolicies))
+	envPolicies, err := mapPolicies(ctx, req.Storage, b.EnvironmentsMap, overrides, node.Environment)
+	if err != nil {
+		b.logger.Warn(fmt.Sprintf("error while accumulate environments policies: %s", err.Error()))
+		return nil, errors.Wrap(err, "environment policies")
+	}
+	envPolicies = dynamicRoleMap(b, templates, envPolicies)
+	b.logger.Debug(fmt.Sprintf("Client %s environment %s policy: %s", client, node.Environment, strings.Join(envPolicies, ",")))
+
+	tagsPolicies, err := mapPolicies(ctx, req.Storage, b.TagsMap, overrides, templates.tags...)
+	if err != nil {
+		b.logger.Warn(fmt.Sprintf("error while accumulate tags policies: %s", err.Error()))
+		return nil, errors.Wrap(err, "tag policies")
+	}
+	tagsPolicies = dynamicRoleMap(b, templates, tagsPolicies)
+	b.logger.Debug(fmt.Sprintf("Client %s tag %s policy: %s", client, strings.Join(templates.tags, ","), strings.Join(tagsPolicies, ",")))
+
+	// Map recipes, a bare cookbook mapping matches any of its recipes
+	recipesPolicies := make([]string, 0)
+	matchedRecipes := make([]string, 0)
+	for _, recipe := range nodeRecipes {
+		recipePolicies, err := mapPolicies(ctx, req.Storage, b.RecipesMap, overrides, recipeMapKeys(recipe)...)
+		if err != nil {
+			b.logger.Warn(fmt.Sprintf("error while accumulate recipes policies: %s", err.Error()))
+			return nil, errors.Wrap(err, "recipe policies")
+		}
+		if len(recipePolicies) > 0 {
+			matchedRecipes = append(matchedRecipes, recipe)
+			recipesPolicies = append(recipesPolicies, recipePolicies...)
+		}
+	}
+	recipesPolicies = dynamicRoleMap(b, templates, recipesPolicies)
+	b.logger.Debug(fmt.Sprintf("Client %s recipe %s policy: %s", client, strings.Join(matchedRecipes, ","), strings.Join(recipesPolicies, ",")))
+
+	// Policyfile nodes have no roles, map their policy name and group instead
+	var policyfilePolicies []string
+	if node.PolicyName != "" {
+		policyNamePolicies, err := mapPolicies(ctx, req.Storage, b.PolicyNamesMap, overrides, node.PolicyName)
+		if err != nil {
+			b.logger.Warn(fmt.Sprintf("error while accumulate policy names policies: %s", err.Error()))
+			return nil, errors.Wrap(err, "policy name policies")
+		}
+		policyfilePolicies = append(policyfilePolicies, policyNamePolicies...)
+	}
+	if node.PolicyGroup != "" {
+		policyGroupPolicies, err := mapPolicies(ctx, req.Storage, b.PolicyGroupsMap, overrides, node.PolicyGroup)
+		if err != nil {
+			b.logger.Warn(fmt.Sprintf("error while accumulate policy groups policies: %s", err.Error()))
+			return nil, errors.Wrap(err, "policy group policies")
+		}
+		policyfilePolicies = append(policyfilePolicies, policyGroupPolicies...)
+	}
+	policyfilePolicies = dynamicRoleMap(b, templates, policyfilePolicies)
+	b.logger.Debug(fmt.Sprintf("Client %s policy name %s group %s policy: %s", client, node.PolicyName, node.PolicyGroup, strings.Join(policyfilePolicies, ",")))
+
+	// Attribute rules are matched against the node object itself
+	rulesPolicies, matchedRules, err := b.rulesPolicies(ctx, req.Storage, node.raw, overrides)
+	if err != nil {
+		b.logger.Warn(fmt.Sprintf("error while accumulate rules policies: %s", err.Error()))
+		return nil, errors.Wrap(err, "rule policies")
+	}
+	rulesPolicies = dynamicRoleMap(b, templates, rulesPolicies)
+	b.logger.Debug(fmt.Sprintf("Client %s rule %s policy: %s", client, strings.Join(matchedRules, ","), strings.Join(rulesPolicies, ",")))
+
+	searchesPolicies, matchedSearches, err := b.searchesPolicies(ctx, req.Storage, config, c, client, overrides)
+	if err != nil {
+		b.logger.Warn(fmt.Sprintf("error while accumulate searches policies: %s", err.Error()))
+		return nil, errors.Wrap(err, "search policies")
+	}
+	searchesPolicies = dynamicRoleMap(b, templates, searchesPolicies)
+	b.logger.Debug(fmt.Sprintf("Client %s search %s policy: %s", client, strings.Join(matchedSearches, ","), strings.Join(searchesPolicies, ",")))
+
+	// Policies declared by the roles and environment themselves
+	var declaredPolicies []string
+	if config.DeclaredPolicies {
+		declaredPolicies, err = b.declaredPolicies(config, c, nodeRoles, node.Environment)
+		if err != nil {
+			b.logger.Warn(fmt.Sprintf("error while accumulate declared policies: %s", err.Error()))
+			return nil, errors.Wrap(err, "declared policies")
+		}
+		b.logger.Debug(fmt.Sprintf("Client %s declared policy: %s", client, strings.Join(declaredPolicies, ",")))
+	}
+
+	policies := make([]string, 0, len(hostsPolicies)+len(rolesPolicies)+len(envPolicies)+len(tagsPolicies)+len(recipesPolicies)+len(policyfilePolicies)+len(rulesPolicies)+len(searchesPolicies)+len(declaredPolicies))
 	policies = append(policies, hostsPolicies...)
 	policies = append(policies, rolesPolicies...)
+	policies = append(policies, envPolicies...)
+	policies = append(policies, tagsPolicies...)
+	policies = append(policies, recipesPolicies...)
+	policies = append(policies, policyfilePolicies...)
+	policies = append(policies, rulesPolicies...)
+	policies = append(policies, searchesPolicies...)
+	policies = append(policies, declaredPolicies...)
 
 	// Append the default policies
 	policies = append(policies, config.AnyonePolicies...)
@@ -216,19 +558,113 @@ func (b *backend) verifyCreds(ctx context.Context, req *logical.Request, client,
 		return nil, logical.CodedError(403, "client has no mapped policies")
 	}
 
-	// Parse TTLs
-	ttl, maxTTL, err := b.SanitizeTTLStr(config.TTL.String(), config.MaxTTL.String())
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to sanitize TTLs")
+	// Return the response
+	creds := newCreds(config, node, policies)
+	creds.roles = nodeRoles
+	creds.recipes = matchedRecipes
+	creds.tags = templates.tags
+	creds.data = templates.data
+	creds.metadata = metadata
+	creds.alias = alias
+	creds.dataBag = discovered.dataBag
+	creds.override(overrides)
+	if err := b.sanitizeCreds(creds); err != nil {
+		b.logger.Warn(fmt.Sprintf("Client %s refused: %s", client, err.Error()))
+		return nil, err
 	}
+	return creds, nil
+}
 
-	// Return the response
+// newCreds returns the credentials of the node with the mount token
+// settings.
+func newCreds(config *config, node *chefNode, policies []string) *verifyResp {
 	return &verifyResp{
 		policies: policies,
-		node:     &node,
-		ttl:      ttl,
-		maxTTL:   maxTTL,
-	}, nil
+		node:     node,
+		ttl:      config.TTL,
+		maxTTL:   config.MaxTTL,
+		period:   config.Period,
+
+		explicitMaxTTL: config.ExplicitMaxTTL,
+		numUses:        config.NumUses,
+		boundCIDRs:     config.BoundCIDRs,
+
+		tokenType:       config.TokenType,
+		noDefaultPolicy: config.NoDefaultPolicy,
+	}
+}
+
+// override replaces the token settings of the credentials with the ones
+// which are set.
+func (creds *verifyResp) override(s *tokenSettings) {
+	if s.TTL > 0 {
+		creds.ttl = s.TTL
+	}
+	if s.MaxTTL > 0 {
+		creds.maxTTL = s.MaxTTL
+	}
+	if s.Period > 0 {
+		creds.period = s.Period
+	}
+	if s.ExplicitMaxTTL > 0 {
+		creds.explicitMaxTTL = s.ExplicitMaxTTL
+	}
+	if s.NumUses > 0 {
+		creds.numUses = s.NumUses
+	}
+	if len(s.BoundCIDRs) > 0 {
+		creds.boundCIDRs = s.BoundCIDRs
+	}
+	if s.TokenType != "" {
+		creds.tokenType = s.TokenType
+	}
+	if s.NoDefaultPolicy {
+		creds.noDefaultPolicy = true
+	}
+}
+
+// sanitizeCreds checks the token settings of the credentials once every
+// override is applied.
+func (b *backend) sanitizeCreds(creds *verifyResp) error {
+	ttl, maxTTL, err := b.sanitizeTTL(creds.ttl, creds.maxTTL)
+	if err != nil {
+		return errors.Wrap(err, "failed to sanitize TTLs")
+	}
+	creds.ttl, creds.maxTTL = ttl, maxTTL
+	return validateTokenType(creds.tokenType, creds.period, creds.numUses)
+}
+
+// verifyRole checks the client against the bound constraints of the login
+// role and maps it to the role's policies.
+func (b *backend) verifyRole(config *config, client, roleName string, role *roleEntry, node *chefNode, nodeRoles []string, templates roleMapTemplates) (*verifyResp, error) {
+	if err := role.checkBounds(client, node, nodeRoles); err != nil {
+		b.logger.Warn(fmt.Sprintf("Client %s refused by role %s: %s", client, roleName, err.Error()))
+		return nil, logical.CodedError(403, "client does not satisfy the role constraints")
+	}
+
+	policies := dynamicRoleMap(b, templates, role.Policies)
+	b.logger.Debug(fmt.Sprintf("Client %s login role %s policy: %s", client, roleName, strings.Join(policies, ",")))
+
+	creds := newCreds(config, node, policies)
+	creds.role = roleName
+	creds.data = templates.data
+
+	// Role token settings take precedence over the mount ones
+	creds.override(&tokenSettings{
+		TTL:             role.TTL,
+		MaxTTL:          role.MaxTTL,
+		Period:          role.Period,
+		ExplicitMaxTTL:  role.ExplicitMaxTTL,
+		NumUses:         role.NumUses,
+		BoundCIDRs:      role.BoundCIDRs,
+		TokenType:       role.TokenType,
+		NoDefaultPolicy: role.NoDefaultPolicy,
+	})
+	if err := b.sanitizeCreds(creds); err != nil {
+		b.logger.Warn(fmt.Sprintf("Client %s refused by role %s: %s", client, roleName, err.Error()))
+		return nil, err
+	}
+	return creds, nil
 }
 
 func dynamicRoleMap(b *backend, templates roleMapTemplates, polices []string) []string {
@@ -237,63 +673,50 @@ func dynamicRoleMap(b *backend, templates roleMapTemplates, polices []string) []
 		b.logger.Debug(fmt.Sprintf("Dynamic policy mapping loop for: %s", p))
 		p = strings.Replace(p, "{{env}}", templates.env, -1)
 		p = strings.Replace(p, "{{name}}", templates.name, -1)
+		p = strings.Replace(p, "{{policy_name}}", templates.policyName, -1)
+		p = strings.Replace(p, "{{policy_group}}", templates.policyGroup, -1)
+		for k, v := range templates.data {
+			p = strings.Replace(p, "{{"+k+"}}", v, -1)
+		}
+
+		// {{tag}} expands to one policy per node tag
+		if strings.Contains(p, "{{tag}}") {
+			for _, tag := range templates.tags {
+				tp := strings.Replace(p, "{{tag}}", tag, -1)
+				b.logger.Debug(fmt.Sprintf("Policy mapped to: %s", tp))
+				mappedPolices = append(mappedPolices, tp)
+			}
+			continue
+		}
+
 		b.logger.Debug(fmt.Sprintf("Policy mapped to: %s", p))
 		mappedPolices = append(mappedPolices, p)
 	}
 	return mappedPolices
 }
 
-// getRolesFromData fetches client run_list from data bags
-func getRolesFromData(dataBags []string, client string, c *chef.Client, b *backend) ([]string, map[string]string) {
-	nodeRoles := make([]string, 0)
-	nodeData := make(map[string]string, 2)
-	//var node chef.Node
-	var dataBag interface{}
-	var err error
-
-	// Get data bags
-	// Iterate over configured data bags indexes and try to find the one for our client.
-
-	for _, dataBagPath := range dataBags {
-		dataBag, err = c.DataBags.GetItem(dataBagPath, client)
-		if err != nil {
-			b.logger.Debug(fmt.Sprintf("Looking for data bag in: %s", err.Error()))
-		}
-		if err == nil {
-			break
-		}
+// getRolesFromData fetches client run_list roles and recipes from data bags
+func getRolesFromData(config *config, client string, c *chef.Client, b *backend) (*runList, error) {
+	raw, err := getDataBagItem(config, c, client, b)
+	if err != nil || raw == nil {
+		return nil, err
 	}
 
-	// Check if we realy got the data bag.
-	jsonData, err := json.Marshal(dataBag)
+	// Encrypted data bag items are decrypted with the shared secret
+	raw, err = decryptDataBagItem(raw, config.DataBagSecret)
 	if err != nil {
-		return nil, nil
+		return nil, err
 	}
-	dataBagMapRunList := gjson.GetBytes(jsonData, "run_list")
 
-	roleRe := regexp.MustCompile("^role\\[(.*)\\]$")
-	for _, role := range dataBagMapRunList.Array() {
-		b.logger.Debug(fmt.Sprintf("Client %s run_list: %s", client, role))
-		res := roleRe.FindStringSubmatch(role.String())
-		if len(res) == 2 {
-			nodeRoles = append(nodeRoles, res[1])
-		}
-	}
-	nodeData["env"] = gjson.GetBytes(jsonData, "env").String()
-	nodeData["id"] = gjson.GetBytes(jsonData, "id").String()
-	return nodeRoles, nodeData
+	item := parseDataBagItem(config, raw)
+	b.logger.Debug(fmt.Sprintf("Client %s data bag roles: %s recipes: %s", client, strings.Join(item.roles, ","), strings.Join(item.recipes, ",")))
+	return item, nil
 }
 
-// getRolesFromNode fetches client run_list from node object
-func getRolesFromNode(node chef.Node, client string, c *chef.Client, b *backend) []string {
-	nodeRoles := make([]string, 0)
-	roleRe := regexp.MustCompile("^role\\[(.*)\\]$")
-	for _, role := range node.RunList {
-		b.logger.Debug(fmt.Sprintf("Client %s run_list: %s", client, role))
-		res := roleRe.FindStringSubmatch(role)
-		if len(res) == 2 {
-			nodeRoles = append(nodeRoles, res[1])
-		}
+// getRolesFromNode fetches client run_list roles and recipes from node object
+func getRolesFromNode(node chef.Node, client string, c *chef.Client, b *backend) ([]string, []string) {
+	for _, item := range node.RunList {
+		b.logger.Debug(fmt.Sprintf("Client %s run_list: %s", client, item))
 	}
-	return nodeRoles
+	return parseRunList(node.RunList)
 }
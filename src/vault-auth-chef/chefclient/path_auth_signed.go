@@ -0,0 +1,243 @@
+package chefclient
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-chef/chef"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/pkg/errors"
+)
+
+const (
+	// signaturesPrefix is the storage prefix of already used signatures.
+	signaturesPrefix = "signatures/"
+)
+
+// errReplayed is returned by useSignature for a login which was already used.
+var errReplayed = errors.New("login was already used")
+
+// usedSignature is the storage entry of an already used login signature.
+type usedSignature struct {
+	Expires time.Time `json:"expires"`
+}
+
+// pathAuthLoginSigned accepts a login request signed with the client's Chef
+// private key and validates the signature against the client's public key to
+// generate a Vault token.
+func (b *backend) pathAuthLoginSigned(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	// Validate we didn't get extraneous fields
+	if err := validateFields(req, d); err != nil {
+		return nil, logical.CodedError(422, err.Error())
+	}
+
+	client := d.Get("client").(string)
+	if client == "" {
+		return errMissingField("client"), nil
+	}
+
+	// The name ends up in Chef API paths and storage keys
+	if !clientNameRe.MatchString(client) {
+		return logical.ErrorResponse(fmt.Sprintf("Bad value for field 'client': invalid client name %q", client)), nil
+	}
+
+	timestamp := d.Get("timestamp").(string)
+	if timestamp == "" {
+		return errMissingField("timestamp"), nil
+	}
+
+	signature := d.Get("signature").(string)
+	if signature == "" {
+		return errMissingField("signature"), nil
+	}
+
+	config, err := b.Config(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := serviceClient(config)
+	if err != nil {
+		b.logger.Warn(fmt.Sprintf("Signed login requires a service credential: %s", err.Error()))
+		return nil, logical.ErrPermissionDenied
+	}
+
+	// Check the request is recent enough
+	signedAt, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("Bad value for field 'timestamp': %s", err)), nil
+	}
+	if err := checkClockSkew(signedAt, time.Now(), config.MaxClockSkew); err != nil {
+		b.logger.Warn(fmt.Sprintf("Client %s signed login timestamp %s refused: %s", client, timestamp, err.Error()))
+		return nil, logical.ErrPermissionDenied
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(signature), ""))
+	if err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("Bad value for field 'signature': %s", err)), nil
+	}
+
+	// Verify the signature against the client's public keys
+	pubKeys, err := clientPublicKeys(c, client)
+	if err != nil {
+		b.logger.Warn(fmt.Sprintf("Chef auth error while getting client keys: %s", err.Error()))
+		return nil, logical.ErrPermissionDenied
+	}
+	canonical := canonicalRequest("/v1/"+req.MountPoint+req.Path, contentHash(req.Data), timestamp, client)
+	if !verifySignature(pubKeys, canonical, sig) {
+		b.logger.Warn(fmt.Sprintf("Client %s signed login has a bad signature", client))
+		return nil, logical.ErrPermissionDenied
+	}
+
+	// Refuse signatures which were already used
+	err = b.useSignature(ctx, req.Storage, client, signedAt, d.Get("nonce").(string), signedAt.Add(config.MaxClockSkew))
+	if err == errReplayed {
+		b.logger.Warn(fmt.Sprintf("Client %s signed login of %s replayed", client, timestamp))
+		return nil, logical.ErrPermissionDenied
+	}
+	if err != nil {
+		b.logger.Error(fmt.Sprintf("Client %s signed login replay check failed: %s", client, err.Error()))
+		return nil, err
+	}
+
+	// Verify the credentails
+	creds, err := b.verifyCreds(ctx, req, config, c, client, d.Get("role").(string))
+	if err != nil {
+		if err, ok := err.(logical.HTTPCodedError); ok {
+			return nil, err
+		}
+		return nil, logical.ErrPermissionDenied
+	}
+
+	// Run the checks made on logins only
+	if err := b.checkLogin(ctx, req, config, client, creds); err != nil {
+		b.logger.Warn(fmt.Sprintf("Client %s login refused: %s", client, err.Error()))
+		return nil, logical.ErrPermissionDenied
+	}
+
+	// Compose the response
+	return b.loginResponse(config, creds, client)
+}
+
+// checkClockSkew checks the signing time is within maxSkew of now, in the
+// past or in the future.
+func checkClockSkew(signedAt, now time.Time, maxSkew time.Duration) error {
+	skew := now.Sub(signedAt)
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > maxSkew {
+		return fmt.Errorf("%s away from the server time, more than the %s allowed", skew, maxSkew)
+	}
+	return nil
+}
+
+// canonicalRequest builds the string signed by the client, following the
+// Chef X-Ops-Sign version 1.0 format.
+func canonicalRequest(path, contentHash, timestamp, client string) string {
+	return strings.Join([]string{
+		"Method:POST",
+		"Hashed Path:" + chef.HashStr(path),
+		"X-Ops-Content-Hash:" + contentHash,
+		"X-Ops-Timestamp:" + timestamp,
+		"X-Ops-UserId:" + client,
+	}, "\n")
+}
+
+// contentHash hashes the login fields, except the signature itself, sorted
+// by name and joined as key=value pairs with '&'.
+func contentHash(data map[string]interface{}) string {
+	pairs := make([]string, 0, len(data))
+	for k, v := range data {
+		if k == "signature" {
+			continue
+		}
+		pairs = append(pairs, fmt.Sprintf("%s=%v", k, v))
+	}
+	sort.Strings(pairs)
+	return chef.HashStr(strings.Join(pairs, "&"))
+}
+
+// verifySignature checks the signature was made over content by the private
+// key of any of the given public keys. Chef signs with a raw PKCS#1 v1.5
+// private encryption of the content, without a digest.
+func verifySignature(pubKeys []*rsa.PublicKey, content string, sig []byte) bool {
+	for _, pub := range pubKeys {
+		if rsa.VerifyPKCS1v15(pub, crypto.Hash(0), []byte(content), sig) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// useSignature records the signed login as used until it expires, returning
+// errReplayed if it was already used. Logins are told apart by client,
+// timestamp and nonce rather than by signature: Chef signatures are
+// deterministic, so two logins of a client within the same second need
+// distinct nonces.
+func (b *backend) useSignature(ctx context.Context, s logical.Storage, client string, signedAt time.Time, nonce string, expires time.Time) error {
+	b.signatureLock.Lock()
+	defer b.signatureLock.Unlock()
+
+	sum := sha256.Sum256([]byte(client + "\n" + signedAt.UTC().Format(time.RFC3339) + "\n" + nonce))
+	key := signaturesPrefix + hex.EncodeToString(sum[:])
+
+	entry, err := s.Get(ctx, key)
+	if err != nil {
+		return errors.Wrap(err, "failed to read signature from storage")
+	}
+	if entry != nil {
+		return errReplayed
+	}
+
+	entry, err = logical.StorageEntryJSON(key, &usedSignature{Expires: expires})
+	if err != nil {
+		return errors.Wrap(err, "failed to generate storage entry")
+	}
+	if err := s.Put(ctx, entry); err != nil {
+		return errors.Wrap(err, "failed to write signature to storage")
+	}
+	return nil
+}
+
+// tidySignatures removes used signatures which can no longer be replayed.
+func (b *backend) tidySignatures(ctx context.Context, s logical.Storage) error {
+	b.signatureLock.Lock()
+	defer b.signatureLock.Unlock()
+
+	keys, err := s.List(ctx, signaturesPrefix)
+	if err != nil {
+		return errors.Wrap(err, "failed to list signatures")
+	}
+
+	now := time.Now()
+	for _, k := range keys {
+		entry, err := s.Get(ctx, signaturesPrefix+k)
+		if err != nil {
+			return errors.Wrap(err, "failed to read signature from storage")
+		}
+		if entry == nil {
+			continue
+		}
+
+		var used usedSignature
+		if err := entry.DecodeJSON(&used); err != nil {
+			return errors.Wrap(err, "failed to decode signature")
+		}
+		if now.After(used.Expires) {
+			if err := s.Delete(ctx, signaturesPrefix+k); err != nil {
+				return errors.Wrap(err, "failed to delete signature")
+			}
+		}
+	}
+	return nil
+}
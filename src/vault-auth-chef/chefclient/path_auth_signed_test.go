@@ -0,0 +1,232 @@
+package chefclient
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chef/chef"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// The request of the mixlib-authentication specs, which Chef servers verify
+// X-Ops-Sign version 1.0 requests against.
+const (
+	specPath       = "/organizations/clownco"
+	specHashedPath = "YtBWDn1blGGuFIuKksdwXzHU9oE="
+	specBody       = "Spec Body"
+	specHashedBody = "DFteJZPVv6WKdQmMqZUQUumUyRs="
+	specTimestamp  = "2009-01-01T12:00:00Z"
+	specUserID     = "spec-user"
+	specCanonical  = "Method:POST\n" +
+		"Hashed Path:" + specHashedPath + "\n" +
+		"X-Ops-Content-Hash:" + specHashedBody + "\n" +
+		"X-Ops-Timestamp:" + specTimestamp + "\n" +
+		"X-Ops-UserId:" + specUserID
+)
+
+func TestCanonicalRequest(t *testing.T) {
+	if got := chef.HashStr(specBody); got != specHashedBody {
+		t.Fatalf("expected body hash %s, got %s", specHashedBody, got)
+	}
+	if got := canonicalRequest(specPath, specHashedBody, specTimestamp, specUserID); got != specCanonical {
+		t.Fatalf("expected canonical request\n%s\ngot\n%s", specCanonical, got)
+	}
+}
+
+func TestContentHash(t *testing.T) {
+	cases := []struct {
+		name string
+		data map[string]interface{}
+		want string
+	}{
+		{
+			name: "fields are sorted and the signature left out",
+			data: map[string]interface{}{
+				"timestamp": "2009-01-01T12:00:00Z",
+				"signature": "c2lnbmF0dXJl",
+				"role":      "web",
+				"client":    "web-01",
+			},
+			// sha1("client=web-01&role=web&timestamp=2009-01-01T12:00:00Z")
+			want: "DC+sJ28XQwU/a0DyRHB4vAZ4c5c=",
+		},
+		{
+			name: "no fields",
+			data: map[string]interface{}{
+				"signature": "c2lnbmF0dXJl",
+			},
+			// sha1("")
+			want: "2jmj7l5rSw0yVb/vlWAYkK/YBwk=",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := contentHash(tc.data); got != tc.want {
+				t.Fatalf("expected %s, got %s", tc.want, got)
+			}
+		})
+	}
+}
+
+// TestVerifySignature signs a login the way knife and chef-client sign their
+// requests and checks the plugin accepts it.
+func TestVerifySignature(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const path = "/v1/auth/chef/login/signed"
+	data := map[string]interface{}{
+		"client": "web-01",
+		"role":   "web",
+	}
+	hash := contentHash(data)
+
+	req, err := http.NewRequest("POST", "https://vault.example.com"+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Ops-Content-Hash", hash)
+	auth := chef.AuthConfig{PrivateKey: key, ClientName: "web-01"}
+	if err := auth.SignRequest(req); err != nil {
+		t.Fatal(err)
+	}
+
+	var lines []string
+	for i := 1; req.Header.Get(fmt.Sprintf("X-Ops-Authorization-%d", i)) != ""; i++ {
+		lines = append(lines, req.Header.Get(fmt.Sprintf("X-Ops-Authorization-%d", i)))
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.Join(lines, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	timestamp := req.Header.Get("X-Ops-Timestamp")
+
+	cases := []struct {
+		name    string
+		pubKeys []*rsa.PublicKey
+		content string
+		want    bool
+	}{
+		{"signed request", []*rsa.PublicKey{&key.PublicKey}, canonicalRequest(path, hash, timestamp, "web-01"), true},
+		{"any of the client keys", []*rsa.PublicKey{&other.PublicKey, &key.PublicKey}, canonicalRequest(path, hash, timestamp, "web-01"), true},
+		{"other key", []*rsa.PublicKey{&other.PublicKey}, canonicalRequest(path, hash, timestamp, "web-01"), false},
+		{"no keys", nil, canonicalRequest(path, hash, timestamp, "web-01"), false},
+		{"other client", []*rsa.PublicKey{&key.PublicKey}, canonicalRequest(path, hash, timestamp, "db-01"), false},
+		{"other path", []*rsa.PublicKey{&key.PublicKey}, canonicalRequest("/v1/auth/other/login/signed", hash, timestamp, "web-01"), false},
+		{"other fields", []*rsa.PublicKey{&key.PublicKey}, canonicalRequest(path, contentHash(map[string]interface{}{"client": "web-01", "role": "admin"}), timestamp, "web-01"), false},
+		{"other timestamp", []*rsa.PublicKey{&key.PublicKey}, canonicalRequest(path, hash, "2009-01-01T12:00:00Z", "web-01"), false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := verifySignature(tc.pubKeys, tc.content, sig); got != tc.want {
+				t.Fatalf("expected %t, got %t", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestCheckClockSkew(t *testing.T) {
+	now := time.Date(2009, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		name     string
+		signedAt time.Time
+		ok       bool
+	}{
+		{"now", now, true},
+		{"within the past skew", now.Add(-4 * time.Minute), true},
+		{"within the future skew", now.Add(4 * time.Minute), true},
+		{"at the limit", now.Add(-5 * time.Minute), true},
+		{"too old", now.Add(-5*time.Minute - time.Second), false},
+		{"too far in the future", now.Add(5*time.Minute + time.Second), false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := checkClockSkew(tc.signedAt, now, defaultMaxClockSkew)
+			if tc.ok && err != nil {
+				t.Fatalf("expected no error, got %s", err)
+			}
+			if !tc.ok && err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+func TestUseSignature(t *testing.T) {
+	ctx := context.Background()
+	s := &logical.InmemStorage{}
+	b := &backend{}
+
+	signedAt := time.Date(2009, 1, 1, 12, 0, 0, 0, time.UTC)
+	expires := time.Now().Add(time.Minute)
+	use := func(client string, signedAt time.Time, nonce string, expires time.Time) error {
+		return b.useSignature(ctx, s, client, signedAt, nonce, expires)
+	}
+
+	if err := use("web-01", signedAt, "", expires); err != nil {
+		t.Fatalf("expected first use to succeed, got %s", err)
+	}
+	if err := use("web-01", signedAt, "", expires); err != errReplayed {
+		t.Fatalf("expected a replayed login to be refused, got %v", err)
+	}
+	if err := use("web-01", signedAt.In(time.FixedZone("CET", 3600)), "", expires); err != errReplayed {
+		t.Fatalf("expected a replayed login in another zone to be refused, got %v", err)
+	}
+
+	// Same second logins differ by nonce, or by client
+	if err := use("web-01", signedAt, "a", expires); err != nil {
+		t.Fatalf("expected a login with a nonce to succeed, got %s", err)
+	}
+	if err := use("web-01", signedAt, "b", expires); err != nil {
+		t.Fatalf("expected a login with another nonce to succeed, got %s", err)
+	}
+	if err := use("web-01", signedAt, "a", expires); err != errReplayed {
+		t.Fatalf("expected a replayed nonce to be refused, got %v", err)
+	}
+	if err := use("web-02", signedAt, "", expires); err != nil {
+		t.Fatalf("expected another client to succeed, got %s", err)
+	}
+	if err := use("web-01", signedAt.Add(time.Second), "", expires); err != nil {
+		t.Fatalf("expected the next second to succeed, got %s", err)
+	}
+
+	// Unexpired signatures are kept by tidy and still refused
+	if err := b.tidySignatures(ctx, s); err != nil {
+		t.Fatal(err)
+	}
+	if err := use("web-01", signedAt, "", expires); err != errReplayed {
+		t.Fatalf("expected a replayed login to be refused after tidy, got %v", err)
+	}
+
+	// Expired signatures are removed by tidy
+	if err := use("web-03", signedAt, "", time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.tidySignatures(ctx, s); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := s.List(ctx, signaturesPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 5 {
+		t.Fatalf("expected 5 signatures left after tidy, got %d", len(keys))
+	}
+}
@@ -0,0 +1,119 @@
+package chefclient
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	log "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// TestLoginClientName checks both login paths refuse client names which
+// could resolve to another client in the Chef API paths, before reading the
+// configuration or touching the storage.
+func TestLoginClientName(t *testing.T) {
+	ctx := context.Background()
+	b := Backend(&logical.BackendConfig{Logger: log.NewNullLogger()})
+
+	clients := []string{"x/../web-01", "../web-01", "web-01/..", "web/01", "/web-01", "web-01/", "..", "."}
+	logins := map[string]map[string]interface{}{
+		"login/key": {
+			"key": "key",
+		},
+		"login/signed": {
+			"timestamp": "2009-01-01T12:00:00Z",
+			"signature": "c2lnbmF0dXJl",
+		},
+	}
+
+	for path, fields := range logins {
+		for _, client := range clients {
+			t.Run(path+" "+client, func(t *testing.T) {
+				s := &logical.InmemStorage{}
+				data := map[string]interface{}{"client": client}
+				for k, v := range fields {
+					data[k] = v
+				}
+
+				resp, err := b.HandleRequest(ctx, &logical.Request{
+					Operation: logical.UpdateOperation,
+					Path:      path,
+					Storage:   s,
+					Data:      data,
+				})
+				if err != nil {
+					t.Fatalf("expected an error response, got %s", err)
+				}
+				if resp == nil || !resp.IsError() || !strings.Contains(resp.Error().Error(), "'client'") {
+					t.Fatalf("expected a bad client error, got %#v", resp)
+				}
+
+				keys, err := s.List(ctx, "")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(keys) != 0 {
+					t.Fatalf("expected no storage writes, got %v", keys)
+				}
+			})
+		}
+	}
+}
+
+// TestRenewCredentials checks renewals are verified with the service
+// credential, and only use a client key for tokens which carry one.
+func TestRenewCredentials(t *testing.T) {
+	ctx := context.Background()
+	b := Backend(&logical.BackendConfig{Logger: log.NewNullLogger()})
+
+	cases := []struct {
+		name         string
+		internalData map[string]interface{}
+		err          error
+	}{
+		{
+			name:         "no service credential",
+			internalData: map[string]interface{}{"chef_client": "web-01"},
+			err:          logical.ErrPermissionDenied,
+		},
+		{
+			name:         "stored client key",
+			internalData: map[string]interface{}{"chef_client": "web-01", "chef_key": "not a key"},
+			err:          logical.ErrPermissionDenied,
+		},
+		{
+			name:         "stored client key not a string",
+			internalData: map[string]interface{}{"chef_client": "web-01", "chef_key": 1},
+		},
+		{
+			name:         "no client",
+			internalData: map[string]interface{}{},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &logical.InmemStorage{}
+			entry := &logical.StorageEntry{
+				Key:   "config",
+				Value: []byte(`{"chef_server": "https://chef.example.com/organizations/example/", "run_list_src": "node"}`),
+			}
+			if err := s.Put(ctx, entry); err != nil {
+				t.Fatal(err)
+			}
+
+			resp, err := b.pathAuthRenew(ctx, &logical.Request{
+				Operation: logical.RenewOperation,
+				Storage:   s,
+				Auth:      &logical.Auth{InternalData: tc.internalData},
+			}, nil)
+			if err == nil {
+				t.Fatalf("expected an error, got %#v", resp)
+			}
+			if tc.err != nil && err != tc.err {
+				t.Fatalf("expected %s, got %s", tc.err, err)
+			}
+		})
+	}
+}
@@ -3,11 +3,15 @@ package chefclient
 import (
 	"context"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/fatih/structs"
-	"github.com/hashicorp/vault/logical"
-	"github.com/hashicorp/vault/logical/framework"
+	"github.com/go-chef/chef"
+	"github.com/hashicorp/go-secure-stdlib/strutil"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/policyutil"
+	"github.com/hashicorp/vault/sdk/logical"
 	"github.com/pkg/errors"
 )
 
@@ -21,6 +25,14 @@ func (b *backend) pathConfigRead(ctx context.Context, req *logical.Request, data
 	// TTLs are stored as seconds
 	config.TTL /= time.Second
 	config.MaxTTL /= time.Second
+	config.MaxClockSkew /= time.Second
+	config.SearchRefresh /= time.Second
+	config.Period /= time.Second
+	config.ExplicitMaxTTL /= time.Second
+	config.MaxNodeStaleness /= time.Second
+	for env, staleness := range config.EnvNodeStaleness {
+		config.EnvNodeStaleness[env] = staleness / time.Second
+	}
 
 	resp := &logical.Response{
 		Data: structs.New(config).Map(),
@@ -35,51 +47,270 @@ func (b *backend) pathConfigWrite(ctx context.Context, req *logical.Request, dat
 		return nil, logical.CodedError(422, err.Error())
 	}
 
+	b.configLock.Lock()
+	defer b.configLock.Unlock()
+
 	// Get the Chef Server address
 	chefServer := data.Get("chef_server").(string)
 	if chefServer == "" {
 		return errMissingField("chef_server"), nil
 	}
 
-	// Get the run list source configuration
-	runListSrc := data.Get("run_list_src").(string)
+	// Get the run list sources, in order, and how their run lists are merged
+	sources, err := parseRunListSources(data.Get("run_list_src").(string))
+	if err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("Bad value for field 'run_list_src': %s", err)), nil
+	}
+	if len(sources) == 0 {
+		return errMissingField("run_list_src"), nil
+	}
+	runListMerge := data.Get("run_list_merge").(string)
+	switch runListMerge {
+	case runListMergeUnion, runListMergeFirstNonEmpty, runListMergeOverride:
+	default:
+		return logical.ErrorResponse(fmt.Sprintf("Bad value for field 'run_list_merge'. Only 'union', 'first_non_empty' or 'override' are allowed.")), nil
+	}
 
-	var dataBags []string
+	// Get the data bags configuration
+	dataBags := data.Get("data_bags").([]string)
+	dataBagItem := data.Get("data_bag_item").(string)
+	dataBagRunListPath := data.Get("data_bag_run_list_path").(string)
+	dataBagEnvironmentPath := data.Get("data_bag_environment_path").(string)
+	dataBagNamePath := data.Get("data_bag_name_path").(string)
+	dataBagFields := data.Get("data_bag_fields").(map[string]string)
+	dataBagSecret := strings.TrimSpace(data.Get("data_bag_secret").(string))
 
-	switch runListSrc {
-	case "":
-		return errMissingField("run_list_src"), nil
-	case "data":
-		// Get the data bags
-		dataBags = data.Get("data_bags").([]string)
-		if len(dataBags) == 0 {
-			return errMissingField("data_bags"), nil
+	// Get the run list expansion mode
+	runListExpansion := data.Get("run_list_expansion").(string)
+	switch runListExpansion {
+	case runListExpansionNone, runListExpansionServer, runListExpansionOhai:
+	default:
+		return logical.ErrorResponse(fmt.Sprintf("Bad value for field 'run_list_expansion'. Only 'none', 'server' or 'ohai' are allowed.")), nil
+	}
+
+	// Get the identity alias source
+	aliasSource := data.Get("alias_source").(string)
+	aliasAttribute := data.Get("alias_attribute").(string)
+	switch aliasSource {
+	case aliasSourceClientName, aliasSourceNodeName:
+	case aliasSourceAttribute:
+		if aliasAttribute == "" {
+			return errMissingField("alias_attribute"), nil
 		}
-		b.logger.Info("Plugin configured to use run_list from data bags.")
-	case "node":
-		b.logger.Info("Plugin configured to use run_list from node object.")
 	default:
-		return logical.ErrorResponse(fmt.Sprintf("Bad value for required field 'run_list_src'. Only 'node' or 'data' are allowed.")), nil
+		return logical.ErrorResponse(fmt.Sprintf("Bad value for field 'alias_source'. Only 'client_name', 'node_name' or 'attribute' are allowed.")), nil
+	}
+
+	groupAliasTags := data.Get("group_alias_tags").(bool)
+
+	// Get the extra token metadata
+	tokenMetadata := data.Get("token_metadata").(map[string]string)
+	if err := validateTokenMetadata(tokenMetadata); err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("Bad value for field 'token_metadata': %s", err)), nil
+	}
+
+	// Policies declared in Chef must be confined to an allowlist
+	declaredPolicies := data.Get("declared_policies").(bool)
+	declaredPolicyAttribute := data.Get("declared_policy_attribute").(string)
+	declaredPolicyPrefixes := lowerPrefixes(data.Get("declared_policy_prefixes").([]string))
+	if declaredPolicies {
+		if declaredPolicyAttribute == "" {
+			return errMissingField("declared_policy_attribute"), nil
+		}
+		if len(declaredPolicyPrefixes) == 0 {
+			return errMissingField("declared_policy_prefixes"), nil
+		}
 	}
 
 	// Get the tunable options
 	skipTLS := data.Get("skip_tls").(bool)
 	anyonePolicies := data.Get("anyone_policies").([]string)
 
+	// The data bag secret is never returned on read either
+	if _, ok := data.GetOk("data_bag_secret"); !ok {
+		if oldConfig, err := b.Config(ctx, req.Storage); err == nil {
+			dataBagSecret = oldConfig.DataBagSecret
+		}
+	}
+
+	// Get the service credential. The key is never returned on read, so keep
+	// the stored one unless a new key is supplied.
+	serviceClient := data.Get("service_client").(string)
+	serviceKey := data.Get("service_key").(string)
+	serviceKeyName := data.Get("service_key_name").(string)
+	if serviceKey == "" && serviceClient != "" {
+		if oldConfig, err := b.Config(ctx, req.Storage); err == nil && oldConfig.ServiceClient == serviceClient {
+			serviceKey = oldConfig.ServiceKey
+			serviceKeyName = oldConfig.ServiceKeyName
+		}
+	}
+	if serviceClient != "" && serviceKey == "" {
+		return errMissingField("service_key"), nil
+	}
+	if serviceKey != "" {
+		if _, err := chef.PrivateKeyFromString([]byte(serviceKey)); err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("Bad value for field 'service_key': %s", err)), nil
+		}
+	}
+
 	// Calculate TTLs, if supplied
 	ttl := time.Duration(data.Get("ttl").(int)) * time.Second
 	maxTTL := time.Duration(data.Get("max_ttl").(int)) * time.Second
+	maxClockSkew := time.Duration(data.Get("max_clock_skew").(int)) * time.Second
+	searchRefresh := time.Duration(data.Get("search_refresh").(int)) * time.Second
+	if searchRefresh <= 0 {
+		return logical.ErrorResponse("Field 'search_refresh' must be positive."), nil
+	}
+
+	// Get the token settings
+	period := time.Duration(data.Get("period").(int)) * time.Second
+	explicitMaxTTL := time.Duration(data.Get("explicit_max_ttl").(int)) * time.Second
+	numUses := data.Get("num_uses").(int)
+	if numUses < 0 {
+		return logical.ErrorResponse("Field 'num_uses' cannot be negative."), nil
+	}
+	boundCIDRs := data.Get("bound_cidrs").([]string)
+	if err := validateCIDRs(boundCIDRs); err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("Bad value for field 'bound_cidrs': %s", err)), nil
+	}
+	tokenType := data.Get("token_type").(string)
+	if tokenType == tokenTypeDefault {
+		tokenType = ""
+	}
+	if err := validateTokenType(tokenType, period, numUses); err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("Bad value for field 'token_type': %s", err)), nil
+	}
+	noDefaultPolicy := data.Get("no_default_policy").(bool)
+
+	// Get the renewal behaviour
+	renewPolicyChange := data.Get("renew_policy_change").(string)
+	switch renewPolicyChange {
+	case renewPolicyChangeDeny, renewPolicyChangeAllowSubset, renewPolicyChangeIgnoreAdditions:
+	default:
+		return logical.ErrorResponse(fmt.Sprintf("Bad value for field 'renew_policy_change'. Only 'deny', 'allow_subset' or 'ignore_additions' are allowed.")), nil
+	}
+
+	// Get the node staleness limits
+	maxNodeStaleness := time.Duration(data.Get("max_node_staleness").(int)) * time.Second
+	envNodeStaleness, err := parseNodeStaleness(data.Get("environment_node_staleness").(map[string]string))
+	if err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("Bad value for field 'environment_node_staleness': %s", err)), nil
+	}
+
+	// Get the machine identity attributes
+	machineIdentity := data.Get("machine_identity").(bool)
+	machineIdentitySource := data.Get("machine_identity_source").(string)
+	switch machineIdentitySource {
+	case machineIdentitySourceNode, machineIdentitySourceLogin:
+	default:
+		return logical.ErrorResponse("Bad value for field 'machine_identity_source'. Only 'node' or 'login' are allowed."), nil
+	}
+	machineIdentityAttributes := data.Get("machine_identity_attributes").([]string)
+	if len(machineIdentityAttributes) == 0 {
+		machineIdentityAttributes = defaultMachineIdentityAttributes
+	}
+
+	// Get the approval queue settings
+	approvalRequired := data.Get("approval_required").(bool)
+	bootstrapPolicies := policyutil.SanitizePolicies(data.Get("bootstrap_policies").([]string), false)
+	approvalRequiredSince, err := b.approvalRequiredSince(ctx, req.Storage, approvalRequired)
+	if err != nil {
+		return nil, err
+	}
+
+	// Get the client address checks
+	bindNodeAddress := data.Get("bind_node_address").(bool)
+	nodeAddressPrefix := data.Get("node_address_prefix").(int)
+	if nodeAddressPrefix < 0 || nodeAddressPrefix > 32 {
+		return logical.ErrorResponse("Field 'node_address_prefix' must be between 0 and 32."), nil
+	}
+	nodeAddress6Prefix := data.Get("node_address6_prefix").(int)
+	if nodeAddress6Prefix < 0 || nodeAddress6Prefix > 128 {
+		return logical.ErrorResponse("Field 'node_address6_prefix' must be between 0 and 128."), nil
+	}
+	nodeAddressDataBagPath := data.Get("node_address_data_bag_path").(string)
+	if nodeAddressDataBagPath != "" && !strutil.StrListContains(sources, "data") {
+		return logical.ErrorResponse("Field 'node_address_data_bag_path' requires the 'data' run_list source."), nil
+	}
+	remoteAddrHeader := data.Get("remote_addr_header").(string)
+	trustedProxies := data.Get("trusted_proxies").([]string)
+	if err := validateCIDRs(trustedProxies); err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("Bad value for field 'trusted_proxies': %s", err)), nil
+	}
+	if remoteAddrHeader != "" && len(trustedProxies) == 0 {
+		return errMissingField("trusted_proxies"), nil
+	}
 
 	// Built the entry
-	entry, err := logical.StorageEntryJSON("config", &config{
-		ChefServer:     chefServer,
-		SkipTLS:        skipTLS,
-		AnyonePolicies: anyonePolicies,
-		RunListSrc:     runListSrc,
-		DataBags:       dataBags,
-		TTL:            ttl,
-		MaxTTL:         maxTTL,
-	})
+	newConfig := &config{
+		ChefServer:       chefServer,
+		SkipTLS:          skipTLS,
+		AnyonePolicies:   anyonePolicies,
+		RunListSrc:       strings.Join(sources, ","),
+		RunListMerge:     runListMerge,
+		RunListExpansion: runListExpansion,
+		DataBags:         dataBags,
+		ServiceClient:    serviceClient,
+		ServiceKey:       serviceKey,
+		ServiceKeyName:   serviceKeyName,
+		TTL:              ttl,
+		MaxTTL:           maxTTL,
+		MaxClockSkew:     maxClockSkew,
+		SearchRefresh:    searchRefresh,
+
+		DeclaredPolicies:        declaredPolicies,
+		DeclaredPolicyAttribute: declaredPolicyAttribute,
+		DeclaredPolicyPrefixes:  declaredPolicyPrefixes,
+
+		DataBagItem:            dataBagItem,
+		DataBagRunListPath:     dataBagRunListPath,
+		DataBagEnvironmentPath: dataBagEnvironmentPath,
+		DataBagNamePath:        dataBagNamePath,
+		DataBagFields:          dataBagFields,
+		DataBagSecret:          dataBagSecret,
+
+		AliasSource:    aliasSource,
+		AliasAttribute: aliasAttribute,
+		GroupAliasTags: groupAliasTags,
+		TokenMetadata:  tokenMetadata,
+
+		Period:          period,
+		ExplicitMaxTTL:  explicitMaxTTL,
+		NumUses:         numUses,
+		BoundCIDRs:      boundCIDRs,
+		TokenType:       tokenType,
+		NoDefaultPolicy: noDefaultPolicy,
+
+		BindNodeAddress:    bindNodeAddress,
+		NodeAddressPrefix:  nodeAddressPrefix,
+		NodeAddress6Prefix: nodeAddress6Prefix,
+		RemoteAddrHeader:   remoteAddrHeader,
+		TrustedProxies:     trustedProxies,
+
+		NodeAddressDataBagPath: nodeAddressDataBagPath,
+
+		RenewPolicyChange: renewPolicyChange,
+		MaxNodeStaleness:  maxNodeStaleness,
+		EnvNodeStaleness:  envNodeStaleness,
+
+		MachineIdentity:           machineIdentity,
+		MachineIdentitySource:     machineIdentitySource,
+		MachineIdentityAttributes: machineIdentityAttributes,
+
+		ApprovalRequired:      approvalRequired,
+		BootstrapPolicies:     bootstrapPolicies,
+		ApprovalRequiredSince: approvalRequiredSince,
+	}
+
+	// Every run list source checks the configuration it needs
+	for _, name := range sources {
+		if err := runListSources[name].validate(newConfig); err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("Bad value for field 'run_list_src': source '%s': %s", name, err)), nil
+		}
+	}
+	b.logger.Info(fmt.Sprintf("Plugin configured to use run_list from %s.", newConfig.RunListSrc))
+
+	entry, err := logical.StorageEntryJSON("config", newConfig)
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to generate storage entry")
 	}
@@ -87,5 +318,8 @@ func (b *backend) pathConfigWrite(ctx context.Context, req *logical.Request, dat
 	if err := req.Storage.Put(ctx, entry); err != nil {
 		return nil, errors.Wrapf(err, "failed to write configuration to storage")
 	}
+
+	// Cached searches may come from another server or credential
+	b.resetSearchCache()
 	return nil, nil
 }
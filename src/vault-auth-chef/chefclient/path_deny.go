@@ -0,0 +1,79 @@
+package chefclient
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/pkg/errors"
+)
+
+// pathDenyList corresponds to LIST auth/chef/deny/:kind.
+func (b *backend) pathDenyList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	patterns, err := req.Storage.List(ctx, denyPrefix+data.Get("kind").(string)+"/")
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list deny entries")
+	}
+	return logical.ListResponse(patterns), nil
+}
+
+// pathDenyRead corresponds to READ auth/chef/deny/:kind/:pattern.
+func (b *backend) pathDenyRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	deny, err := b.Deny(ctx, req.Storage, data.Get("kind").(string), strings.ToLower(data.Get("pattern").(string)))
+	if err != nil {
+		return nil, err
+	}
+	if deny == nil {
+		return nil, nil
+	}
+
+	expires := ""
+	if !deny.Expires.IsZero() {
+		expires = deny.Expires.Format(time.RFC3339)
+	}
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"reason":  deny.Reason,
+			"expires": expires,
+			"expired": deny.expired(time.Now()),
+		},
+	}, nil
+}
+
+// pathDenyWrite corresponds to POST auth/chef/deny/:kind/:pattern.
+func (b *backend) pathDenyWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	// Validate we didn't get extraneous fields
+	if err := validateFields(req, data); err != nil {
+		return nil, logical.CodedError(422, err.Error())
+	}
+
+	deny := &denyEntry{
+		Reason: data.Get("reason").(string),
+	}
+	if ttl := time.Duration(data.Get("ttl").(int)) * time.Second; ttl > 0 {
+		deny.Expires = time.Now().UTC().Add(ttl)
+	}
+
+	// Chef names are matched case-insensitively
+	pattern := strings.ToLower(data.Get("pattern").(string))
+	entry, err := logical.StorageEntryJSON(denyPrefix+data.Get("kind").(string)+"/"+pattern, deny)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to generate storage entry")
+	}
+
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return nil, errors.Wrapf(err, "failed to write deny entry to storage")
+	}
+	return nil, nil
+}
+
+// pathDenyDelete corresponds to DELETE auth/chef/deny/:kind/:pattern.
+func (b *backend) pathDenyDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	pattern := strings.ToLower(data.Get("pattern").(string))
+	if err := req.Storage.Delete(ctx, denyPrefix+data.Get("kind").(string)+"/"+pattern); err != nil {
+		return nil, errors.Wrapf(err, "failed to delete deny entry")
+	}
+	return nil, nil
+}
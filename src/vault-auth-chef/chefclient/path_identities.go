@@ -0,0 +1,56 @@
+package chefclient
+
+import (
+	"context"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/pkg/errors"
+)
+
+// pathIdentitiesList corresponds to LIST auth/chef/identities.
+func (b *backend) pathIdentitiesList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	clients, err := req.Storage.List(ctx, identitiesPrefix)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list identities")
+	}
+	return logical.ListResponse(clients), nil
+}
+
+// pathIdentitiesRead corresponds to READ auth/chef/identities/:client.
+func (b *backend) pathIdentitiesRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	identity, err := b.Identity(ctx, req.Storage, data.Get("client").(string))
+	if err != nil {
+		return nil, err
+	}
+	if identity == nil {
+		return nil, nil
+	}
+
+	source := identity.Source
+	if source == "" {
+		source = machineIdentitySourceNode
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"source":      source,
+			"attributes":  identity.Attributes,
+			"fingerprint": identity.Fingerprint,
+			"bound_at":    identity.BoundAt.Format(time.RFC3339),
+		},
+	}, nil
+}
+
+// pathIdentitiesDelete corresponds to DELETE auth/chef/identities/:client.
+// The client is bound again on its next login.
+func (b *backend) pathIdentitiesDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.identityLock.Lock()
+	defer b.identityLock.Unlock()
+
+	if err := req.Storage.Delete(ctx, identitiesPrefix+data.Get("client").(string)); err != nil {
+		return nil, errors.Wrapf(err, "failed to delete identity")
+	}
+	return nil, nil
+}
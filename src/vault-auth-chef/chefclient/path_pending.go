@@ -0,0 +1,184 @@
+package chefclient
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/pkg/errors"
+)
+
+// pathPendingList corresponds to LIST auth/chef/pending.
+func (b *backend) pathPendingList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	clients, err := req.Storage.List(ctx, pendingPrefix)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list pending clients")
+	}
+	return logical.ListResponse(clients), nil
+}
+
+// pathPendingRead corresponds to READ auth/chef/pending/:client.
+func (b *backend) pathPendingRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	pending, err := b.Pending(ctx, req.Storage, data.Get("client").(string))
+	if err != nil {
+		return nil, err
+	}
+	if pending == nil {
+		return nil, nil
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"environment": pending.Environment,
+			"roles":       pending.Roles,
+			"remote_addr": pending.RemoteAddr,
+			"first_seen":  pending.FirstSeen.Format(time.RFC3339),
+			"last_seen":   pending.LastSeen.Format(time.RFC3339),
+			"rejected":    pending.Rejected,
+		},
+	}, nil
+}
+
+// pathPendingDelete corresponds to DELETE auth/chef/pending/:client.
+func (b *backend) pathPendingDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.approvalLock.Lock()
+	defer b.approvalLock.Unlock()
+
+	if err := req.Storage.Delete(ctx, pendingPrefix+data.Get("client").(string)); err != nil {
+		return nil, errors.Wrapf(err, "failed to delete pending client")
+	}
+	return nil, nil
+}
+
+// pathPendingApprove corresponds to POST auth/chef/pending/:client/approve.
+func (b *backend) pathPendingApprove(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.approvalLock.Lock()
+	defer b.approvalLock.Unlock()
+
+	client := data.Get("client").(string)
+	if err := b.approve(ctx, req.Storage, client); err != nil {
+		return nil, err
+	}
+
+	b.logger.Info(fmt.Sprintf("Client %s approved", client))
+	return nil, nil
+}
+
+// pathApprovedList corresponds to LIST auth/chef/approved.
+func (b *backend) pathApprovedList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	clients, err := req.Storage.List(ctx, approvedPrefix)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list approved clients")
+	}
+	return logical.ListResponse(clients), nil
+}
+
+// pathApprovedWrite corresponds to POST auth/chef/approved. It approves a
+// list of clients, or every client of the Chef server but the rejected ones,
+// to seed the approvals of a mount in use.
+func (b *backend) pathApprovedWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	// Validate we didn't get extraneous fields
+	if err := validateFields(req, data); err != nil {
+		return nil, logical.CodedError(422, err.Error())
+	}
+
+	clients := data.Get("clients").([]string)
+	chefClients := data.Get("chef_clients").(bool)
+	if len(clients) == 0 && !chefClients {
+		return errMissingField("clients"), nil
+	}
+	for _, client := range clients {
+		if !clientNameRe.MatchString(client) {
+			return logical.ErrorResponse(fmt.Sprintf("Bad value for field 'clients': invalid client name %q", client)), nil
+		}
+	}
+
+	var registered []string
+	if chefClients {
+		config, err := b.Config(ctx, req.Storage)
+		if err != nil {
+			return nil, err
+		}
+		c, err := serviceClient(config)
+		if err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("Field 'chef_clients' requires a service credential: %s", err)), nil
+		}
+		list, err := c.Clients.List()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to list Chef clients")
+		}
+		for client := range list {
+			registered = append(registered, client)
+		}
+	}
+
+	b.approvalLock.Lock()
+	defer b.approvalLock.Unlock()
+
+	approved := make([]string, 0, len(clients)+len(registered))
+	for _, client := range clients {
+		if err := b.approve(ctx, req.Storage, client); err != nil {
+			return nil, err
+		}
+		approved = append(approved, client)
+	}
+
+	// Chef clients rejected before keep their rejection
+	for _, client := range registered {
+		pending, err := b.Pending(ctx, req.Storage, client)
+		if err != nil {
+			return nil, err
+		}
+		if pending != nil && pending.Rejected {
+			continue
+		}
+		if err := b.approve(ctx, req.Storage, client); err != nil {
+			return nil, err
+		}
+		approved = append(approved, client)
+	}
+	sort.Strings(approved)
+
+	b.logger.Info(fmt.Sprintf("%d clients approved", len(approved)))
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"approved": approved,
+		},
+	}, nil
+}
+
+// pathPendingReject corresponds to POST auth/chef/pending/:client/reject.
+func (b *backend) pathPendingReject(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.approvalLock.Lock()
+	defer b.approvalLock.Unlock()
+
+	client := data.Get("client").(string)
+	pending, err := b.Pending(ctx, req.Storage, client)
+	if err != nil {
+		return nil, err
+	}
+	if pending == nil {
+		now := time.Now().UTC()
+		pending = &pendingEntry{FirstSeen: now, LastSeen: now}
+	}
+	pending.Rejected = true
+
+	entry, err := logical.StorageEntryJSON(pendingPrefix+client, pending)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to generate storage entry")
+	}
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return nil, errors.Wrapf(err, "failed to write pending client to storage")
+	}
+
+	// Rejecting an approved client withdraws its approval
+	if err := req.Storage.Delete(ctx, approvedPrefix+client); err != nil {
+		return nil, errors.Wrapf(err, "failed to delete approved client")
+	}
+
+	b.logger.Info(fmt.Sprintf("Client %s rejected", client))
+	return nil, nil
+}
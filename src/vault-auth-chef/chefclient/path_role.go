@@ -0,0 +1,121 @@
+package chefclient
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/fatih/structs"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/policyutil"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/pkg/errors"
+)
+
+// pathRoleList corresponds to LIST auth/chef/role.
+func (b *backend) pathRoleList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	roles, err := req.Storage.List(ctx, rolePrefix)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list roles")
+	}
+	return logical.ListResponse(roles), nil
+}
+
+// pathRoleRead corresponds to READ auth/chef/role/:name.
+func (b *backend) pathRoleRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	role, err := b.Role(ctx, req.Storage, data.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		return nil, nil
+	}
+
+	// TTLs are stored as seconds
+	role.TTL /= time.Second
+	role.MaxTTL /= time.Second
+	role.Period /= time.Second
+	role.ExplicitMaxTTL /= time.Second
+
+	return &logical.Response{
+		Data: structs.New(role).Map(),
+	}, nil
+}
+
+// pathRoleWrite corresponds to POST auth/chef/role/:name.
+func (b *backend) pathRoleWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	// Validate we didn't get extraneous fields
+	if err := validateFields(req, data); err != nil {
+		return nil, logical.CodedError(422, err.Error())
+	}
+
+	name := strings.ToLower(data.Get("name").(string))
+	if name == "" {
+		return errMissingField("name"), nil
+	}
+
+	role := &roleEntry{
+		BoundChefRoles:    data.Get("bound_chef_roles").([]string),
+		BoundEnvironments: data.Get("bound_environments").([]string),
+		BoundClientNames:  data.Get("bound_client_names").([]string),
+		BoundPolicyGroups: data.Get("bound_policy_groups").([]string),
+		Policies:          policyutil.SanitizePolicies(data.Get("policies").([]string), false),
+		TTL:               time.Duration(data.Get("ttl").(int)) * time.Second,
+		MaxTTL:            time.Duration(data.Get("max_ttl").(int)) * time.Second,
+		Period:            time.Duration(data.Get("period").(int)) * time.Second,
+		ExplicitMaxTTL:    time.Duration(data.Get("explicit_max_ttl").(int)) * time.Second,
+		NumUses:           data.Get("num_uses").(int),
+		BoundCIDRs:        data.Get("bound_cidrs").([]string),
+		TokenType:         data.Get("token_type").(string),
+		NoDefaultPolicy:   data.Get("no_default_policy").(bool),
+	}
+
+	// A role without constraints would let any client in
+	if len(role.BoundChefRoles) == 0 && len(role.BoundEnvironments) == 0 &&
+		len(role.BoundClientNames) == 0 && len(role.BoundPolicyGroups) == 0 {
+		return logical.ErrorResponse("At least one bound constraint must be set."), nil
+	}
+
+	if len(role.Policies) == 0 {
+		return errMissingField("policies"), nil
+	}
+
+	if role.MaxTTL > 0 && role.TTL > role.MaxTTL {
+		return logical.ErrorResponse("Field 'ttl' cannot be greater than 'max_ttl'."), nil
+	}
+
+	if role.NumUses < 0 {
+		return logical.ErrorResponse("Field 'num_uses' cannot be negative."), nil
+	}
+
+	if err := validateCIDRs(role.BoundCIDRs); err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("Bad value for field 'bound_cidrs': %s", err)), nil
+	}
+
+	if role.TokenType == tokenTypeDefault {
+		role.TokenType = ""
+	}
+	if err := validateTokenType(role.TokenType, role.Period, role.NumUses); err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("Bad value for field 'token_type': %s", err)), nil
+	}
+
+	entry, err := logical.StorageEntryJSON(rolePrefix+name, role)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to generate storage entry")
+	}
+
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return nil, errors.Wrapf(err, "failed to write role to storage")
+	}
+	return nil, nil
+}
+
+// pathRoleDelete corresponds to DELETE auth/chef/role/:name.
+func (b *backend) pathRoleDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := strings.ToLower(data.Get("name").(string))
+	if err := req.Storage.Delete(ctx, rolePrefix+name); err != nil {
+		return nil, errors.Wrapf(err, "failed to delete role")
+	}
+	return nil, nil
+}
@@ -0,0 +1,130 @@
+package chefclient
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/go-chef/chef"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/pkg/errors"
+)
+
+// clientKeyCreate is the body of a Chef keys API request generating a new
+// client key on the server.
+type clientKeyCreate struct {
+	Name           string `json:"name"`
+	CreateKey      bool   `json:"create_key"`
+	ExpirationDate string `json:"expiration_date"`
+}
+
+// clientKeyCreateResult is the response of the Chef keys API to a key
+// creation.
+type clientKeyCreateResult struct {
+	URI        string `json:"uri"`
+	PrivateKey string `json:"private_key"`
+}
+
+// pathRotateRoot corresponds to POST auth/chef/config/rotate-root.
+func (b *backend) pathRotateRoot(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.configLock.Lock()
+	defer b.configLock.Unlock()
+
+	config, err := b.Config(ctx, req.Storage)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get configuration from storage")
+	}
+
+	c, err := serviceClient(config)
+	if err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("Cannot rotate: %s", err)), nil
+	}
+
+	// Generate the new key on the Chef server
+	oldKey, oldKeyName := config.ServiceKey, config.ServiceKeyName
+	newKeyName, err := rotatedKeyName(time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	var created clientKeyCreateResult
+	path := fmt.Sprintf("clients/%s/keys", config.ServiceClient)
+	if err := chefRequest(c, "POST", path, &clientKeyCreate{
+		Name:           newKeyName,
+		CreateKey:      true,
+		ExpirationDate: "infinity",
+	}, &created); err != nil {
+		return nil, errors.Wrapf(err, "failed to create a new key for client %q", config.ServiceClient)
+	}
+	if created.PrivateKey == "" {
+		return nil, errors.New("chef server did not return the new private key")
+	}
+
+	// Make sure the new key works before storing it
+	newClient, err := newChefClient(config, config.ServiceClient, created.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := newClient.Clients.ListKeys(config.ServiceClient); err != nil {
+		return nil, errors.Wrapf(err, "failed to authenticate with the new key %q", newKeyName)
+	}
+
+	config.ServiceKey = created.PrivateKey
+	config.ServiceKeyName = newKeyName
+	entry, err := logical.StorageEntryJSON("config", config)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to generate storage entry")
+	}
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return nil, errors.Wrapf(err, "failed to write configuration to storage")
+	}
+
+	// Retire the old key
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			"service_client":   config.ServiceClient,
+			"service_key_name": newKeyName,
+		},
+	}
+	if oldKeyName != "" {
+		if err := retireKey(newClient, config.ServiceClient, oldKeyName, oldKey); err != nil {
+			b.logger.Warn(fmt.Sprintf("Failed to delete old service key %q: %s", oldKeyName, err.Error()))
+			resp.AddWarning(fmt.Sprintf("The new key is stored, but the old key %q could not be deleted from the Chef server: %s", oldKeyName, err))
+		}
+	}
+	return resp, nil
+}
+
+// rotatedKeyName names a new service key after the rotation time, with a
+// random suffix so that rotations within the same second do not collide.
+func rotatedKeyName(now time.Time) (string, error) {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", errors.Wrap(err, "failed to generate the key name")
+	}
+	return fmt.Sprintf("vault-%s-%s", now.UTC().Format("20060102150405"), hex.EncodeToString(suffix)), nil
+}
+
+// retireKey deletes the named key of the client from the Chef server, only
+// if it is the key the plugin was using. The name may not match the key when
+// the service key was configured without its name.
+func retireKey(c *chef.Client, client, name, key string) error {
+	chefKey, err := c.Clients.GetKey(client, name)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get key %q", name)
+	}
+	pub, err := parsePublicKey(chefKey.PublicKey)
+	if err != nil {
+		return errors.Wrapf(err, "failed to parse key %q", name)
+	}
+	if !keyMatches(key, []*rsa.PublicKey{pub}) {
+		return fmt.Errorf("key %q on the Chef server is not the configured service key", name)
+	}
+
+	path := fmt.Sprintf("clients/%s/keys/%s", client, name)
+	return chefRequest(c, "DELETE", path, nil, nil)
+}
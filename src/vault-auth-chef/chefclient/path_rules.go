@@ -0,0 +1,97 @@
+package chefclient
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/fatih/structs"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/policyutil"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/pkg/errors"
+)
+
+// pathRulesList corresponds to LIST auth/chef/map/rules.
+func (b *backend) pathRulesList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	rules, err := req.Storage.List(ctx, rulesPrefix)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list rules")
+	}
+	return logical.ListResponse(rules), nil
+}
+
+// pathRulesRead corresponds to READ auth/chef/map/rules/:name.
+func (b *backend) pathRulesRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	rule, err := b.Rule(ctx, req.Storage, data.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+	if rule == nil {
+		return nil, nil
+	}
+
+	resp := &logical.Response{
+		Data: structs.New(rule).Map(),
+	}
+	for k, v := range rule.tokenSettings.fields() {
+		resp.Data[k] = v
+	}
+	return resp, nil
+}
+
+// pathRulesWrite corresponds to POST auth/chef/map/rules/:name.
+func (b *backend) pathRulesWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	// Validate we didn't get extraneous fields
+	if err := validateFields(req, data); err != nil {
+		return nil, logical.CodedError(422, err.Error())
+	}
+
+	name := strings.ToLower(data.Get("name").(string))
+	if name == "" {
+		return errMissingField("name"), nil
+	}
+
+	rule := &ruleEntry{
+		Policies: policyutil.SanitizePolicies(data.Get("policy").([]string), false),
+		Match:    strings.TrimSpace(data.Get("match").(string)),
+	}
+
+	if len(rule.Policies) == 0 {
+		return errMissingField("policy"), nil
+	}
+
+	if rule.Match == "" {
+		return errMissingField("match"), nil
+	}
+
+	// Refuse expressions which would never be evaluated
+	if _, err := parseRule(rule.Match); err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("Bad value for field 'match': %s", err)), nil
+	}
+
+	settings, err := parseTokenSettings(data)
+	if err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("Bad token settings: %s", err)), nil
+	}
+	rule.tokenSettings = *settings
+
+	entry, err := logical.StorageEntryJSON(rulesPrefix+name, rule)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to generate storage entry")
+	}
+
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return nil, errors.Wrapf(err, "failed to write rule to storage")
+	}
+	return nil, nil
+}
+
+// pathRulesDelete corresponds to DELETE auth/chef/map/rules/:name.
+func (b *backend) pathRulesDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := strings.ToLower(data.Get("name").(string))
+	if err := req.Storage.Delete(ctx, rulesPrefix+name); err != nil {
+		return nil, errors.Wrapf(err, "failed to delete rule")
+	}
+	return nil, nil
+}
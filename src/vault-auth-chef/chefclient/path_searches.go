@@ -0,0 +1,96 @@
+package chefclient
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/fatih/structs"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/policyutil"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/pkg/errors"
+)
+
+// pathSearchesList corresponds to LIST auth/chef/map/searches.
+func (b *backend) pathSearchesList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	searches, err := req.Storage.List(ctx, searchesPrefix)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list searches")
+	}
+	return logical.ListResponse(searches), nil
+}
+
+// pathSearchesRead corresponds to READ auth/chef/map/searches/:name.
+func (b *backend) pathSearchesRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	search, err := b.Search(ctx, req.Storage, data.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+	if search == nil {
+		return nil, nil
+	}
+
+	resp := &logical.Response{
+		Data: structs.New(search).Map(),
+	}
+	for k, v := range search.tokenSettings.fields() {
+		resp.Data[k] = v
+	}
+	return resp, nil
+}
+
+// pathSearchesWrite corresponds to POST auth/chef/map/searches/:name.
+func (b *backend) pathSearchesWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	// Validate we didn't get extraneous fields
+	if err := validateFields(req, data); err != nil {
+		return nil, logical.CodedError(422, err.Error())
+	}
+
+	name := strings.ToLower(data.Get("name").(string))
+	if name == "" {
+		return errMissingField("name"), nil
+	}
+
+	search := &searchEntry{
+		Policies: policyutil.SanitizePolicies(data.Get("policy").([]string), false),
+		Query:    strings.TrimSpace(data.Get("query").(string)),
+	}
+
+	if len(search.Policies) == 0 {
+		return errMissingField("policy"), nil
+	}
+
+	if search.Query == "" {
+		return errMissingField("query"), nil
+	}
+
+	if err := validateSearchQuery(search.Query); err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("Bad value for field 'query': %s", err)), nil
+	}
+
+	settings, err := parseTokenSettings(data)
+	if err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("Bad token settings: %s", err)), nil
+	}
+	search.tokenSettings = *settings
+
+	entry, err := logical.StorageEntryJSON(searchesPrefix+name, search)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to generate storage entry")
+	}
+
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return nil, errors.Wrapf(err, "failed to write search to storage")
+	}
+	return nil, nil
+}
+
+// pathSearchesDelete corresponds to DELETE auth/chef/map/searches/:name.
+func (b *backend) pathSearchesDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := strings.ToLower(data.Get("name").(string))
+	if err := req.Storage.Delete(ctx, searchesPrefix+name); err != nil {
+		return nil, errors.Wrapf(err, "failed to delete search")
+	}
+	return nil, nil
+}
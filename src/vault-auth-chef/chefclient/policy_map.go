@@ -0,0 +1,147 @@
+package chefclient
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/pkg/errors"
+)
+
+// policyMapPaths builds the same paths as PathMap.Paths, but with a custom
+// pattern for the mapping key and the token settings a mapping overrides.
+// PathMap only allows [-\w]+ keys, which rules out names such as
+// "cookbook::recipe".
+func policyMapPaths(p *framework.PolicyMap, keyPattern string) []*framework.Path {
+	fields := tokenSettingsFields()
+	fields["key"] = &framework.FieldSchema{
+		Type:        framework.TypeString,
+		Description: fmt.Sprintf("Key for the %s mapping", p.Name),
+	}
+	fields[p.PolicyKey] = &framework.FieldSchema{
+		Type:        framework.TypeString,
+		Description: fmt.Sprintf("Comma-separated list of policies for the %s mapping", p.Name),
+	}
+
+	return []*framework.Path{
+		&framework.Path{
+			Pattern: fmt.Sprintf("map/%s/?$", p.Name),
+
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ListOperation: policyMapList(p),
+				logical.ReadOperation: policyMapList(p),
+			},
+
+			HelpSynopsis: fmt.Sprintf("Read mappings for %s", p.Name),
+		},
+
+		&framework.Path{
+			Pattern: fmt.Sprintf(`map/%s/(?P<key>%s)`, p.Name, keyPattern),
+
+			Fields: fields,
+
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.CreateOperation: policyMapWrite(p),
+				logical.ReadOperation:   policyMapRead(p),
+				logical.UpdateOperation: policyMapWrite(p),
+				logical.DeleteOperation: policyMapDelete(p),
+			},
+
+			HelpSynopsis: fmt.Sprintf("Read/write/delete a single %s mapping", p.Name),
+
+			ExistenceCheck: policyMapExistenceCheck(p),
+		},
+	}
+}
+
+func policyMapList(p *framework.PolicyMap) framework.OperationFunc {
+	return func(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+		keys, err := p.List(ctx, req.Storage, "")
+		if err != nil {
+			return nil, err
+		}
+		return logical.ListResponse(keys), nil
+	}
+}
+
+func policyMapRead(p *framework.PolicyMap) framework.OperationFunc {
+	return func(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+		v, err := p.Get(ctx, req.Storage, d.Get("key").(string))
+		if err != nil {
+			return nil, err
+		}
+		return &logical.Response{
+			Data: v,
+		}, nil
+	}
+}
+
+func policyMapWrite(p *framework.PolicyMap) framework.OperationFunc {
+	return func(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+		// Validate we didn't get extraneous fields
+		if err := validateFields(req, d); err != nil {
+			return nil, logical.CodedError(422, err.Error())
+		}
+
+		settings, err := parseTokenSettings(d)
+		if err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("Bad token settings: %s", err)), nil
+		}
+
+		// Only the settings which are set are stored along with the policies
+		v := settings.fields()
+		v[p.PolicyKey] = d.Get(p.PolicyKey).(string)
+		err = p.Put(ctx, req.Storage, d.Get("key").(string), v)
+		return nil, err
+	}
+}
+
+func policyMapDelete(p *framework.PolicyMap) framework.OperationFunc {
+	return func(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+		err := p.Delete(ctx, req.Storage, d.Get("key").(string))
+		return nil, err
+	}
+}
+
+func policyMapExistenceCheck(p *framework.PolicyMap) framework.ExistenceFunc {
+	return func(ctx context.Context, req *logical.Request, d *framework.FieldData) (bool, error) {
+		v, err := p.Get(ctx, req.Storage, d.Get("key").(string))
+		if err != nil {
+			return false, err
+		}
+		return v != nil, nil
+	}
+}
+
+// mapPolicies returns the policies the keys are mapped to, like
+// PolicyMap.Policies, and restricts settings with the token settings of the
+// matching mappings.
+func mapPolicies(ctx context.Context, s logical.Storage, p *framework.PolicyMap, settings *tokenSettings, keys ...string) ([]string, error) {
+	policies := make([]string, 0)
+	for _, key := range keys {
+		v, err := p.Get(ctx, s, key)
+		if err != nil {
+			return nil, err
+		}
+		value, ok := v[p.PolicyKey].(string)
+		if !ok {
+			continue
+		}
+		for _, policy := range strings.Split(value, ",") {
+			if policy = strings.TrimSpace(policy); policy != "" {
+				policies = append(policies, policy)
+			}
+		}
+
+		mapSettings, err := tokenSettingsFromMap(v)
+		if err != nil {
+			return nil, errors.Wrapf(err, "bad token settings in %s mapping %q", p.Name, key)
+		}
+		if err := settings.restrict(mapSettings); err != nil {
+			return nil, errors.Wrapf(err, "%s mapping %q", p.Name, key)
+		}
+	}
+	return policies, nil
+}
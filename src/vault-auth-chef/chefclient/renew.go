@@ -0,0 +1,67 @@
+package chefclient
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// renewPolicyChangeDeny refuses renewals when the policies changed.
+	renewPolicyChangeDeny = "deny"
+	// renewPolicyChangeAllowSubset renews when policies were only removed.
+	renewPolicyChangeAllowSubset = "allow_subset"
+	// renewPolicyChangeIgnoreAdditions renews when policies were only added.
+	renewPolicyChangeIgnoreAdditions = "ignore_additions"
+)
+
+// policyDiff returns the policies added to and removed from the old set,
+// leaving out the default policy which every token has.
+func policyDiff(old, new []string) (added, removed []string) {
+	oldSet := newStringSet(old...)
+	newSet := newStringSet(new...)
+	for _, p := range newSet.list() {
+		if _, ok := oldSet.seen[p]; !ok && p != "default" {
+			added = append(added, p)
+		}
+	}
+	for _, p := range oldSet.list() {
+		if _, ok := newSet.seen[p]; !ok && p != "default" {
+			removed = append(removed, p)
+		}
+	}
+	return added, removed
+}
+
+// checkPolicyChange decides whether a token can be renewed after its
+// policies changed from old to new, according to the renew_policy_change
+// mode. It returns a warning naming the difference, if any.
+func checkPolicyChange(mode string, old, new []string) (string, error) {
+	added, removed := policyDiff(old, new)
+	if len(added) == 0 && len(removed) == 0 {
+		return "", nil
+	}
+
+	diff := make([]string, 0, 2)
+	if len(added) > 0 {
+		diff = append(diff, "added "+strings.Join(added, ", "))
+	}
+	if len(removed) > 0 {
+		diff = append(diff, "removed "+strings.Join(removed, ", "))
+	}
+	change := strings.Join(diff, "; ")
+
+	switch mode {
+	case renewPolicyChangeAllowSubset:
+		if len(added) > 0 {
+			return "", fmt.Errorf("policies no longer match: %s", change)
+		}
+		return fmt.Sprintf("Policies changed (%s), the token keeps its policies until the next login", change), nil
+	case renewPolicyChangeIgnoreAdditions:
+		if len(removed) > 0 {
+			return "", fmt.Errorf("policies no longer match: %s", change)
+		}
+		return fmt.Sprintf("Policies changed (%s), log in again to get the new policies", change), nil
+	default:
+		return "", fmt.Errorf("policies no longer match: %s", change)
+	}
+}
@@ -0,0 +1,96 @@
+package chefclient
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPolicyDiff(t *testing.T) {
+	cases := []struct {
+		name     string
+		old, new []string
+		added    []string
+		removed  []string
+	}{
+		{"no change", []string{"web", "db"}, []string{"web", "db"}, nil, nil},
+		{"reordered", []string{"web", "db"}, []string{"db", "web"}, nil, nil},
+		{"duplicates", []string{"web", "web"}, []string{"web"}, nil, nil},
+		{"addition", []string{"web"}, []string{"web", "db"}, []string{"db"}, nil},
+		{"removal", []string{"web", "db"}, []string{"web"}, nil, []string{"db"}},
+		{"addition and removal", []string{"web", "db"}, []string{"web", "api"}, []string{"api"}, []string{"db"}},
+		{"from none", nil, []string{"web"}, []string{"web"}, nil},
+		{"to none", []string{"web"}, nil, nil, []string{"web"}},
+		{"default added", []string{"web"}, []string{"web", "default"}, nil, nil},
+		{"default removed", []string{"default", "web"}, []string{"web"}, nil, nil},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			added, removed := policyDiff(tc.old, tc.new)
+			if !reflect.DeepEqual(added, tc.added) {
+				t.Fatalf("expected added %v, got %v", tc.added, added)
+			}
+			if !reflect.DeepEqual(removed, tc.removed) {
+				t.Fatalf("expected removed %v, got %v", tc.removed, removed)
+			}
+		})
+	}
+}
+
+func TestCheckPolicyChange(t *testing.T) {
+	same := []string{"default", "web"}
+	added := []string{"default", "web", "db"}
+	removed := []string{"default"}
+	both := []string{"default", "db"}
+
+	cases := []struct {
+		mode    string
+		new     []string
+		ok      bool
+		warning string
+	}{
+		{renewPolicyChangeDeny, same, true, ""},
+		{renewPolicyChangeDeny, added, false, ""},
+		{renewPolicyChangeDeny, removed, false, ""},
+		{renewPolicyChangeDeny, both, false, ""},
+
+		{renewPolicyChangeAllowSubset, same, true, ""},
+		{renewPolicyChangeAllowSubset, added, false, ""},
+		{renewPolicyChangeAllowSubset, removed, true, "removed web"},
+		{renewPolicyChangeAllowSubset, both, false, ""},
+
+		{renewPolicyChangeIgnoreAdditions, same, true, ""},
+		{renewPolicyChangeIgnoreAdditions, added, true, "added db"},
+		{renewPolicyChangeIgnoreAdditions, removed, false, ""},
+		{renewPolicyChangeIgnoreAdditions, both, false, ""},
+
+		// Configurations without a mode deny
+		{"", same, true, ""},
+		{"", added, false, ""},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.mode+" "+strings.Join(tc.new, ","), func(t *testing.T) {
+			warning, err := checkPolicyChange(tc.mode, []string{"default", "web"}, tc.new)
+			if !tc.ok {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				if !strings.Contains(err.Error(), "policies no longer match") {
+					t.Fatalf("expected a policy mismatch, got %s", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected no error, got %s", err)
+			}
+			if tc.warning == "" && warning != "" {
+				t.Fatalf("expected no warning, got %q", warning)
+			}
+			if !strings.Contains(warning, tc.warning) {
+				t.Fatalf("expected a warning containing %q, got %q", tc.warning, warning)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package chefclient
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-secure-stdlib/strutil"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/pkg/errors"
+)
+
+const (
+	// rolePrefix is the storage prefix of login roles.
+	rolePrefix = "role/"
+)
+
+// roleEntry represents a named login role with the constraints a client must
+// meet to log in with it.
+type roleEntry struct {
+	// BoundChefRoles, if set, requires the node to have any of these roles.
+	BoundChefRoles []string `json:"bound_chef_roles" structs:"bound_chef_roles"`
+	// BoundEnvironments, if set, requires the node to be in any of these
+	// environments.
+	BoundEnvironments []string `json:"bound_environments" structs:"bound_environments"`
+	// BoundClientNames, if set, requires the client name to match any of
+	// these glob patterns.
+	BoundClientNames []string `json:"bound_client_names" structs:"bound_client_names"`
+	// BoundPolicyGroups, if set, requires the node to be in any of these
+	// Policyfile policy groups.
+	BoundPolicyGroups []string `json:"bound_policy_groups" structs:"bound_policy_groups"`
+
+	// Policies are granted to clients logging in with the role instead of
+	// the mount wide mappings.
+	Policies []string `json:"policies" structs:"policies"`
+
+	// TTL, MaxTTL and Period override the mount TTLs.
+	TTL    time.Duration `json:"ttl" structs:"ttl,omitempty"`
+	MaxTTL time.Duration `json:"max_ttl" structs:"max_ttl,omitempty"`
+	Period time.Duration `json:"period" structs:"period,omitempty"`
+
+	// ExplicitMaxTTL, NumUses, BoundCIDRs, TokenType and NoDefaultPolicy
+	// override the mount token settings.
+	ExplicitMaxTTL  time.Duration `json:"explicit_max_ttl" structs:"explicit_max_ttl,omitempty"`
+	NumUses         int           `json:"num_uses" structs:"num_uses,omitempty"`
+	BoundCIDRs      []string      `json:"bound_cidrs" structs:"bound_cidrs,omitempty"`
+	TokenType       string        `json:"token_type" structs:"token_type,omitempty"`
+	NoDefaultPolicy bool          `json:"no_default_policy" structs:"no_default_policy"`
+}
+
+// Role returns the named login role from the storage backend, or nil if it
+// does not exist.
+func (b *backend) Role(ctx context.Context, s logical.Storage, name string) (*roleEntry, error) {
+	entry, err := s.Get(ctx, rolePrefix+strings.ToLower(name))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get role %q from storage", name)
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var result roleEntry
+	if err := entry.DecodeJSON(&result); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode role %q", name)
+	}
+
+	return &result, nil
+}
+
+// checkBounds verifies the client and its node meet every bound constraint
+// of the role.
+func (r *roleEntry) checkBounds(client string, node *chefNode, nodeRoles []string) error {
+	if len(r.BoundClientNames) > 0 && !strutil.StrListContainsGlob(r.BoundClientNames, client) {
+		return fmt.Errorf("client name %q is not bound to the role", client)
+	}
+
+	if len(r.BoundEnvironments) > 0 && !strutil.StrListContains(r.BoundEnvironments, node.Environment) {
+		return fmt.Errorf("environment %q is not bound to the role", node.Environment)
+	}
+
+	if len(r.BoundPolicyGroups) > 0 && !strutil.StrListContains(r.BoundPolicyGroups, node.PolicyGroup) {
+		return fmt.Errorf("policy group %q is not bound to the role", node.PolicyGroup)
+	}
+
+	if len(r.BoundChefRoles) > 0 {
+		found := false
+		for _, role := range nodeRoles {
+			if strutil.StrListContains(r.BoundChefRoles, role) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("none of the roles %q is bound to the role", nodeRoles)
+		}
+	}
+
+	return nil
+}
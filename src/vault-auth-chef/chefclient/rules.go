@@ -0,0 +1,548 @@
+package chefclient
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/go-version"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/pkg/errors"
+	"github.com/tidwall/gjson"
+)
+
+const (
+	// rulesPrefix is the storage prefix of attribute rule mappings.
+	rulesPrefix = "rules/"
+)
+
+// ruleEntry maps nodes whose attributes match an expression to a series of
+// policies.
+type ruleEntry struct {
+	Policies []string `json:"policy" structs:"policy"`
+	Match    string   `json:"match" structs:"match"`
+
+	// tokenSettings override the token settings of matching nodes.
+	tokenSettings
+}
+
+// Rule returns the named attribute rule from the storage backend, or nil if
+// it does not exist.
+func (b *backend) Rule(ctx context.Context, s logical.Storage, name string) (*ruleEntry, error) {
+	entry, err := s.Get(ctx, rulesPrefix+strings.ToLower(name))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get rule %q from storage", name)
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var result ruleEntry
+	if err := entry.DecodeJSON(&result); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode rule %q", name)
+	}
+
+	return &result, nil
+}
+
+// rulesPolicies evaluates every attribute rule against the node JSON and
+// returns the policies of the matching rules along with their names. The
+// token settings of the matching rules restrict settings.
+func (b *backend) rulesPolicies(ctx context.Context, s logical.Storage, nodeJSON []byte, settings *tokenSettings) ([]string, []string, error) {
+	names, err := s.List(ctx, rulesPrefix)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to list rules")
+	}
+
+	policies := make([]string, 0)
+	matched := make([]string, 0)
+	for _, name := range names {
+		rule, err := b.Rule(ctx, s, name)
+		if err != nil {
+			return nil, nil, err
+		}
+		if rule == nil {
+			continue
+		}
+
+		expr, err := parseRule(rule.Match)
+		if err != nil {
+			b.logger.Warn(fmt.Sprintf("Skipping rule %s with bad match expression: %s", name, err.Error()))
+			continue
+		}
+		if expr.eval(nodeJSON) {
+			if err := settings.restrict(&rule.tokenSettings); err != nil {
+				return nil, nil, errors.Wrapf(err, "rule %q", name)
+			}
+			matched = append(matched, name)
+			policies = append(policies, rule.Policies...)
+		}
+	}
+	return policies, matched, nil
+}
+
+// ruleExpr is a parsed rule match expression.
+type ruleExpr interface {
+	eval(doc []byte) bool
+}
+
+type ruleOr struct{ left, right ruleExpr }
+
+func (e *ruleOr) eval(doc []byte) bool { return e.left.eval(doc) || e.right.eval(doc) }
+
+type ruleAnd struct{ left, right ruleExpr }
+
+func (e *ruleAnd) eval(doc []byte) bool { return e.left.eval(doc) && e.right.eval(doc) }
+
+type ruleNot struct{ expr ruleExpr }
+
+func (e *ruleNot) eval(doc []byte) bool { return !e.expr.eval(doc) }
+
+// ruleTruthy matches when the attribute exists and is not false, null or an
+// empty string.
+type ruleTruthy struct{ path string }
+
+func (e *ruleTruthy) eval(doc []byte) bool {
+	res := gjson.GetBytes(doc, e.path)
+	switch res.Type {
+	case gjson.Null, gjson.False:
+		return false
+	case gjson.String:
+		return res.Str != ""
+	}
+	return res.Exists()
+}
+
+// ruleCompare compares an attribute with a literal value. Equality and regex
+// matches against a list attribute match any of its items.
+type ruleCompare struct {
+	path  string
+	op    string
+	value gjson.Result
+	re    *regexp.Regexp
+}
+
+func (e *ruleCompare) eval(doc []byte) bool {
+	res := gjson.GetBytes(doc, e.path)
+	if !res.Exists() {
+		return e.op == "!="
+	}
+
+	switch e.op {
+	case "==":
+		return anyItem(res, func(r gjson.Result) bool { return resultsEqual(r, e.value) })
+	case "!=":
+		return !anyItem(res, func(r gjson.Result) bool { return resultsEqual(r, e.value) })
+	case "=~":
+		return anyItem(res, func(r gjson.Result) bool { return e.re.MatchString(r.String()) })
+	}
+
+	cmp, ok := compareResults(res, e.value)
+	if !ok {
+		return false
+	}
+	switch e.op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+// ruleIn matches when the attribute equals any of the listed values.
+type ruleIn struct {
+	path   string
+	values []gjson.Result
+}
+
+func (e *ruleIn) eval(doc []byte) bool {
+	res := gjson.GetBytes(doc, e.path)
+	if !res.Exists() {
+		return false
+	}
+	return anyItem(res, func(r gjson.Result) bool {
+		for _, v := range e.values {
+			if resultsEqual(r, v) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// anyItem applies fn to the attribute, or to each of its items if it is a
+// list, and reports whether any of them matched.
+func anyItem(res gjson.Result, fn func(gjson.Result) bool) bool {
+	if !res.IsArray() {
+		return fn(res)
+	}
+	for _, item := range res.Array() {
+		if fn(item) {
+			return true
+		}
+	}
+	return false
+}
+
+// resultsEqual reports whether an attribute equals a literal value.
+func resultsEqual(a, b gjson.Result) bool {
+	switch {
+	case a.Type == gjson.String && b.Type == gjson.String:
+		return a.Str == b.Str
+	case b.Type == gjson.True || b.Type == gjson.False || b.Type == gjson.Null:
+		return a.Type == b.Type
+	}
+	cmp, ok := compareResults(a, b)
+	return ok && cmp == 0
+}
+
+// compareResults orders an attribute and a literal value, as numbers when
+// both are numeric, as versions when both are version strings and as
+// strings otherwise. ok is false when the values cannot be ordered.
+func compareResults(a, b gjson.Result) (int, bool) {
+	if af, ok := resultNumber(a); ok {
+		if bf, ok := resultNumber(b); ok {
+			switch {
+			case af < bf:
+				return -1, true
+			case af > bf:
+				return 1, true
+			}
+			return 0, true
+		}
+	}
+
+	if a.Type == gjson.String || a.Type == gjson.Number {
+		if av, err := version.NewVersion(a.String()); err == nil {
+			if bv, err := version.NewVersion(b.String()); err == nil {
+				return av.Compare(bv), true
+			}
+		}
+	}
+
+	if a.Type == gjson.String && b.Type == gjson.String {
+		return strings.Compare(a.Str, b.Str), true
+	}
+	return 0, false
+}
+
+// resultNumber returns the numeric value of a number or numeric string.
+func resultNumber(r gjson.Result) (float64, bool) {
+	switch r.Type {
+	case gjson.Number:
+		return r.Num, true
+	case gjson.String:
+		f, err := strconv.ParseFloat(r.Str, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// ruleTokenKind is the kind of a match expression token.
+type ruleTokenKind int
+
+const (
+	ruleTokEOF ruleTokenKind = iota
+	ruleTokPath
+	ruleTokString
+	ruleTokNumber
+	ruleTokOp
+)
+
+type ruleToken struct {
+	kind ruleTokenKind
+	text string
+	pos  int
+}
+
+// ruleOps are the operators and punctuation of match expressions, longest
+// first.
+var ruleOps = []string{"==", "!=", "<=", ">=", "=~", "&&", "||", "<", ">", "!", "(", ")", "[", "]", ","}
+
+// isRulePathChar reports whether c may appear in an attribute path.
+func isRulePathChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		strings.IndexByte("_.-*?#@\\", c) >= 0
+}
+
+// tokenizeRule splits a match expression into tokens.
+func tokenizeRule(s string) ([]ruleToken, error) {
+	var tokens []ruleToken
+	i := 0
+outer:
+	for i < len(s) {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+			continue
+		case c == '"':
+			j := i + 1
+			for j < len(s) && s[j] != '"' {
+				if s[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(s) {
+				return nil, fmt.Errorf("unterminated string at offset %d", i)
+			}
+			str, err := strconv.Unquote(s[i : j+1])
+			if err != nil {
+				return nil, fmt.Errorf("bad string at offset %d: %s", i, err)
+			}
+			tokens = append(tokens, ruleToken{ruleTokString, str, i})
+			i = j + 1
+			continue
+		case c == '-' || c >= '0' && c <= '9':
+			j := i + 1
+			for j < len(s) && (s[j] >= '0' && s[j] <= '9' || s[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, ruleToken{ruleTokNumber, s[i:j], i})
+			i = j
+			continue
+		}
+
+		for _, op := range ruleOps {
+			if strings.HasPrefix(s[i:], op) {
+				tokens = append(tokens, ruleToken{ruleTokOp, op, i})
+				i += len(op)
+				continue outer
+			}
+		}
+
+		if !isRulePathChar(c) {
+			return nil, fmt.Errorf("unexpected character %q at offset %d", c, i)
+		}
+		j := i
+		for j < len(s) && isRulePathChar(s[j]) {
+			if s[j] == '\\' && j+1 < len(s) {
+				j++
+			}
+			j++
+		}
+		tokens = append(tokens, ruleToken{ruleTokPath, s[i:j], i})
+		i = j
+	}
+	return append(tokens, ruleToken{ruleTokEOF, "", len(s)}), nil
+}
+
+// ruleParser is a recursive descent parser of match expressions:
+//
+//	expr       = and { ("or" | "||") and }
+//	and        = unary { ("and" | "&&") unary }
+//	unary      = ("not" | "!") unary | "(" expr ")" | comparison
+//	comparison = path [ op value | "in" "[" [ value { "," value } ] "]" ]
+//	op         = "==" | "!=" | "<" | "<=" | ">" | ">=" | "=~"
+//	value      = string | number | "true" | "false" | "null"
+//
+// A bare path matches when the attribute is set and not false, null or "".
+type ruleParser struct {
+	tokens []ruleToken
+	pos    int
+}
+
+// parseRule parses a match expression.
+func parseRule(s string) (ruleExpr, error) {
+	tokens, err := tokenizeRule(s)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &ruleParser{tokens: tokens}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != ruleTokEOF {
+		return nil, fmt.Errorf("unexpected %q at offset %d", tok.text, tok.pos)
+	}
+	return expr, nil
+}
+
+func (p *ruleParser) peek() ruleToken {
+	return p.tokens[p.pos]
+}
+
+func (p *ruleParser) next() ruleToken {
+	tok := p.tokens[p.pos]
+	if tok.kind != ruleTokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// is reports whether the next token is any of the given operators or
+// keywords.
+func (p *ruleParser) is(texts ...string) bool {
+	tok := p.peek()
+	if tok.kind != ruleTokOp && tok.kind != ruleTokPath {
+		return false
+	}
+	for _, t := range texts {
+		if tok.text == t {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *ruleParser) expect(text string) error {
+	if tok := p.next(); tok.kind != ruleTokOp || tok.text != text {
+		return fmt.Errorf("expected %q at offset %d", text, tok.pos)
+	}
+	return nil
+}
+
+func (p *ruleParser) parseOr() (ruleExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.is("or", "||") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &ruleOr{left, right}
+	}
+	return left, nil
+}
+
+func (p *ruleParser) parseAnd() (ruleExpr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.is("and", "&&") {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &ruleAnd{left, right}
+	}
+	return left, nil
+}
+
+func (p *ruleParser) parseUnary() (ruleExpr, error) {
+	switch {
+	case p.is("not", "!"):
+		p.next()
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &ruleNot{expr}, nil
+	case p.is("("):
+		p.next()
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return expr, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *ruleParser) parseComparison() (ruleExpr, error) {
+	tok := p.next()
+	if tok.kind != ruleTokPath || isRuleKeyword(tok.text) {
+		return nil, fmt.Errorf("expected an attribute path at offset %d", tok.pos)
+	}
+	path := tok.text
+
+	switch {
+	case p.is("==", "!=", "<", "<=", ">", ">=", "=~"):
+		op := p.next().text
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		expr := &ruleCompare{path: path, op: op, value: value}
+		if op == "=~" {
+			if value.Type != gjson.String {
+				return nil, fmt.Errorf("regular expression of %q must be a string", path)
+			}
+			if expr.re, err = regexp.Compile(value.Str); err != nil {
+				return nil, fmt.Errorf("bad regular expression for %q: %s", path, err)
+			}
+		}
+		return expr, nil
+	case p.is("in"):
+		p.next()
+		values, err := p.parseList()
+		if err != nil {
+			return nil, err
+		}
+		return &ruleIn{path: path, values: values}, nil
+	}
+	return &ruleTruthy{path}, nil
+}
+
+func (p *ruleParser) parseList() ([]gjson.Result, error) {
+	if err := p.expect("["); err != nil {
+		return nil, err
+	}
+	values := make([]gjson.Result, 0)
+	if p.is("]") {
+		p.next()
+		return values, nil
+	}
+	for {
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+		if p.is("]") {
+			p.next()
+			return values, nil
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// parseValue parses a literal into the JSON value it represents. Numbers
+// which are not valid JSON numbers, such as 1.2.3, are taken as strings.
+func (p *ruleParser) parseValue() (gjson.Result, error) {
+	tok := p.next()
+	switch tok.kind {
+	case ruleTokString:
+		return gjson.Parse(strconv.Quote(tok.text)), nil
+	case ruleTokNumber:
+		if _, err := strconv.ParseFloat(tok.text, 64); err == nil {
+			return gjson.Parse(tok.text), nil
+		}
+		return gjson.Parse(strconv.Quote(tok.text)), nil
+	case ruleTokPath:
+		switch tok.text {
+		case "true", "false", "null":
+			return gjson.Parse(tok.text), nil
+		}
+	}
+	return gjson.Result{}, fmt.Errorf("expected a value at offset %d", tok.pos)
+}
+
+// isRuleKeyword reports whether the word is reserved in match expressions.
+func isRuleKeyword(s string) bool {
+	switch s {
+	case "and", "or", "not", "in", "true", "false", "null":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,188 @@
+package chefclient
+
+import (
+	"testing"
+)
+
+const ruleTestNode = `{
+  "name": "web-01",
+  "chef_environment": "production",
+  "automatic": {
+    "platform": "ubuntu",
+    "platform_version": "18.04",
+    "memory": {"total_mb": 4096},
+    "cpu": {"total": 4},
+    "virtualization": {"role": "guest"},
+    "tags": ["web", "frontend"],
+    "ports": [80, 443],
+    "fqdn": "web-01.example.com",
+    "hostname": ""
+  },
+  "normal": {
+    "app": {"owner": "team-a", "enabled": true, "debug": false, "notes": null}
+  }
+}`
+
+func TestRuleEval(t *testing.T) {
+	cases := []struct {
+		match string
+		want  bool
+	}{
+		// Bare paths
+		{`automatic.fqdn`, true},
+		{`normal.app.enabled`, true},
+		{`normal.app.debug`, false},
+		{`normal.app.notes`, false},
+		{`automatic.hostname`, false},
+		{`automatic.missing`, false},
+
+		// Strings
+		{`automatic.platform == "ubuntu"`, true},
+		{`automatic.platform == "centos"`, false},
+		{`automatic.platform != "centos"`, true},
+		{`automatic.platform < "zz"`, true},
+		{`automatic.platform > "zz"`, false},
+
+		// Numbers and numeric strings
+		{`automatic.memory.total_mb >= 4096`, true},
+		{`automatic.memory.total_mb > 4096`, false},
+		{`automatic.memory.total_mb < 8192.5`, true},
+		{`automatic.cpu.total == 4`, true},
+		{`automatic.cpu.total == "4"`, true},
+		{`automatic.cpu.total <= -1`, false},
+		{`automatic.platform_version >= 16.04`, true},
+		{`automatic.platform_version < 9.10`, false},
+
+		// Versions
+		{`automatic.platform_version >= 18.4.0`, true},
+		{`automatic.platform_version < 18.10.1`, true},
+
+		// Mixed types do not order
+		{`automatic.platform > 1`, false},
+		{`automatic.tags == true`, false},
+		{`normal.app.enabled == true`, true},
+		{`normal.app.debug == false`, true},
+		{`normal.app.notes == null`, true},
+
+		// Lists match any item
+		{`automatic.tags == "web"`, true},
+		{`automatic.tags != "web"`, false},
+		{`automatic.tags != "db"`, true},
+		{`automatic.ports == 443`, true},
+		{`automatic.tags =~ "^front"`, true},
+
+		// in
+		{`chef_environment in ["staging", "production"]`, true},
+		{`chef_environment in ["staging"]`, false},
+		{`chef_environment in []`, false},
+		{`automatic.cpu.total in [2, 4, 8]`, true},
+		{`automatic.tags in ["db", "frontend"]`, true},
+		{`automatic.missing in ["x"]`, false},
+
+		// Regular expressions
+		{`automatic.fqdn =~ "\\.example\\.com$"`, true},
+		{`automatic.fqdn =~ "^db-"`, false},
+		{`automatic.cpu.total =~ "^4$"`, true},
+
+		// Missing attributes
+		{`automatic.missing == "x"`, false},
+		{`automatic.missing != "x"`, true},
+		{`automatic.missing < 1`, false},
+		{`automatic.missing =~ ".*"`, false},
+		{`!automatic.missing`, true},
+
+		// Boolean operators
+		{`automatic.platform == "ubuntu" && chef_environment == "production"`, true},
+		{`automatic.platform == "ubuntu" && chef_environment == "staging"`, false},
+		{`automatic.platform == "centos" || chef_environment == "production"`, true},
+		{`automatic.platform == "centos" || chef_environment == "staging"`, false},
+		{`!(automatic.platform == "ubuntu")`, false},
+		{`! ! automatic.fqdn`, true},
+		{`automatic.platform == "ubuntu" and not normal.app.debug`, true},
+		{`automatic.platform == "centos" or normal.app.enabled`, true},
+
+		// && binds tighter than ||, ! tighter than both
+		{`automatic.platform == "ubuntu" || automatic.platform == "centos" && chef_environment == "staging"`, true},
+		{`(automatic.platform == "ubuntu" || automatic.platform == "centos") && chef_environment == "staging"`, false},
+		{`chef_environment == "staging" && automatic.fqdn || normal.app.enabled`, true},
+		{`chef_environment == "staging" && (automatic.fqdn || normal.app.enabled)`, false},
+		{`!normal.app.debug && normal.app.enabled`, true},
+		{`!(normal.app.debug || normal.app.enabled)`, false},
+		{`!normal.app.debug || automatic.missing`, true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.match, func(t *testing.T) {
+			expr, err := parseRule(tc.match)
+			if err != nil {
+				t.Fatalf("failed to parse: %s", err)
+			}
+			if got := expr.eval([]byte(ruleTestNode)); got != tc.want {
+				t.Fatalf("expected %t, got %t", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestParseRuleErrors(t *testing.T) {
+	cases := []string{
+		``,
+		`   `,
+		`==`,
+		`automatic.platform ==`,
+		`automatic.platform == ubuntu`,
+		`automatic.platform === "ubuntu"`,
+		`automatic.platform == "ubuntu`,
+		`automatic.platform == "\q"`,
+		`automatic.platform "ubuntu"`,
+		`(automatic.platform == "ubuntu"`,
+		`automatic.platform == "ubuntu")`,
+		`automatic.platform == "ubuntu" &&`,
+		`|| automatic.platform`,
+		`!`,
+		`()`,
+		`automatic.fqdn =~ "("`,
+		`automatic.fqdn =~ 1`,
+		`chef_environment in`,
+		`chef_environment in "production"`,
+		`chef_environment in ["production"`,
+		`chef_environment in ["production",]`,
+		`chef_environment in ["production" "staging"]`,
+		`and == "x"`,
+		`true`,
+		`automatic.platform == "ubuntu" $ 1`,
+		`automatic.platform & "ubuntu"`,
+	}
+
+	for _, match := range cases {
+		t.Run(match, func(t *testing.T) {
+			if _, err := parseRule(match); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+// TestParseRuleNoPanic parses every prefix of well-formed expressions, which
+// covers most ways an expression can be cut short, and evaluates whatever
+// parses against malformed documents.
+func TestParseRuleNoPanic(t *testing.T) {
+	matches := []string{
+		`automatic.platform == "ubuntu" && !(chef_environment in ["a", "b"] || normal.x =~ "^y\\d")`,
+		`automatic.memory.total_mb >= -1.5 or not automatic.cpu.total < 1.2.3`,
+		`"\\" ) ( ] [ , - -- 1.. \ \\ "é"`,
+	}
+	docs := []string{``, `{`, `[]`, `null`, `"string"`, `{"automatic": [1, {"platform": 2}]}`, ruleTestNode}
+
+	for _, match := range matches {
+		for i := 0; i <= len(match); i++ {
+			expr, err := parseRule(match[:i])
+			if err != nil {
+				continue
+			}
+			for _, doc := range docs {
+				expr.eval([]byte(doc))
+			}
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package chefclient
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/go-chef/chef"
+	"github.com/pkg/errors"
+)
+
+const (
+	// runListExpansionNone keeps only the roles listed in the run_list.
+	runListExpansionNone = "none"
+	// runListExpansionServer expands nested roles through the Chef roles API.
+	runListExpansionServer = "server"
+	// runListExpansionOhai uses the roles reported by the last chef-client run.
+	runListExpansionOhai = "ohai"
+)
+
+// roleRe matches a role entry of a run_list.
+var roleRe = regexp.MustCompile(`^role\[(.*)\]$`)
+
+// chefObjectNameRe matches the names Chef allows for roles and environments,
+// which are looked up by name in the Chef API paths.
+var chefObjectNameRe = regexp.MustCompile(`^[\w-]+$`)
+
+// recipeRe matches a recipe entry of a run_list, with an optional version
+// pin such as recipe[foo::bar@1.2.0].
+var recipeRe = regexp.MustCompile(`^recipe\[([^@\]]+)(?:@[^\]]*)?\]$`)
+
+// roleObject is a Chef role object along with its environment specific run
+// lists, which go-chef does not decode.
+type roleObject struct {
+	Name        string              `json:"name"`
+	RunList     []string            `json:"run_list"`
+	EnvRunLists map[string][]string `json:"env_run_lists"`
+}
+
+// parseRunList splits run_list items into role names and recipe names.
+// Recipes are normalized to cookbook::recipe without their version pin.
+func parseRunList(items []string) ([]string, []string) {
+	roles := make([]string, 0)
+	recipes := make([]string, 0)
+	for _, item := range items {
+		if res := roleRe.FindStringSubmatch(item); len(res) == 2 {
+			roles = append(roles, res[1])
+			continue
+		}
+		if res := recipeRe.FindStringSubmatch(item); len(res) == 2 {
+			recipes = append(recipes, normalizeRecipe(res[1]))
+			continue
+		}
+		// Chef treats bare run_list items as recipes
+		if item != "" && !strings.Contains(item, "[") {
+			recipes = append(recipes, normalizeRecipe(item))
+		}
+	}
+	return roles, recipes
+}
+
+// normalizeRecipe strips the version pin of a recipe name and adds the
+// default recipe to bare cookbook names.
+func normalizeRecipe(name string) string {
+	if i := strings.Index(name, "@"); i >= 0 {
+		name = name[:i]
+	}
+	if !strings.Contains(name, "::") {
+		name += "::default"
+	}
+	return name
+}
+
+// recipeMapKeys returns the map/recipes keys matching a recipe: the recipe
+// itself and its cookbook, which matches any recipe of the cookbook.
+func recipeMapKeys(recipe string) []string {
+	cookbook := strings.SplitN(recipe, "::", 2)[0]
+	return []string{recipe, cookbook}
+}
+
+// expandRunList expands the top level roles of a run_list according to the
+// configured expansion mode, collecting the recipes of the expanded roles.
+func expandRunList(mode string, c *chef.Client, node *chefNode, roles, recipes []string, b *backend) ([]string, []string, error) {
+	switch mode {
+	case runListExpansionServer:
+		return expandRunListServer(c, node.Environment, roles, recipes, b)
+	case runListExpansionOhai:
+		roles, recipes = expandRunListOhai(node, roles, recipes)
+		return roles, recipes, nil
+	default:
+		return roles, recipes, nil
+	}
+}
+
+// expandRunListServer recursively expands roles through the Chef roles API,
+// honouring environment specific run lists. Roles already expanded are
+// skipped, which also breaks cycles.
+func expandRunListServer(c *chef.Client, env string, roles, recipes []string, b *backend) ([]string, []string, error) {
+	seen := make(map[string]struct{}, len(roles))
+	expanded := make([]string, 0, len(roles))
+	allRecipes := newStringSet(recipes...)
+
+	queue := append([]string{}, roles...)
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		seen[name] = struct{}{}
+		expanded = append(expanded, name)
+
+		if !chefObjectNameRe.MatchString(name) {
+			b.logger.Warn(fmt.Sprintf("Role %q from run_list is not a valid role name", name))
+			continue
+		}
+
+		var role roleObject
+		if err := chefRequest(c, "GET", "roles/"+name, nil, &role); err != nil {
+			if resp, ok := err.(*chef.ErrorResponse); ok && resp.Response.StatusCode == http.StatusNotFound {
+				b.logger.Warn(fmt.Sprintf("Role %s from run_list does not exist", name))
+				continue
+			}
+			return nil, nil, errors.Wrapf(err, "failed to get role %q", name)
+		}
+
+		runList := role.RunList
+		if envRunList, ok := role.EnvRunLists[env]; ok {
+			runList = envRunList
+		}
+		nestedRoles, nestedRecipes := parseRunList(runList)
+		queue = append(queue, nestedRoles...)
+		allRecipes.add(nestedRecipes...)
+	}
+
+	return expanded, allRecipes.list(), nil
+}
+
+// expandRunListOhai adds the roles and recipes the node reported after its
+// last chef-client run. Roles come from automatic.roles only, recipes from
+// automatic.recipes and automatic.expanded_run_list, which lists recipes.
+func expandRunListOhai(node *chefNode, roles, recipes []string) ([]string, []string) {
+	allRoles := newStringSet(roles...)
+	allRecipes := newStringSet(recipes...)
+
+	allRoles.add(stringsAttribute(node.AutomaticAttributes, "roles")...)
+	for _, recipe := range stringsAttribute(node.AutomaticAttributes, "recipes") {
+		allRecipes.add(normalizeRecipe(recipe))
+	}
+	_, expandedRecipes := parseRunList(stringsAttribute(node.AutomaticAttributes, "expanded_run_list"))
+	allRecipes.add(expandedRecipes...)
+
+	return allRoles.list(), allRecipes.list()
+}
+
+// stringsAttribute returns the string items of a list attribute.
+func stringsAttribute(attrs map[string]interface{}, key string) []string {
+	list, ok := attrs[key].([]interface{})
+	if !ok {
+		return nil
+	}
+
+	result := make([]string, 0, len(list))
+	for _, v := range list {
+		if s, ok := v.(string); ok {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+// stringSet is an insertion ordered set of strings.
+type stringSet struct {
+	seen  map[string]struct{}
+	items []string
+}
+
+// newStringSet creates a set holding the given items.
+func newStringSet(items ...string) *stringSet {
+	s := &stringSet{seen: make(map[string]struct{}, len(items))}
+	s.add(items...)
+	return s
+}
+
+// add adds the non-empty items missing from the set.
+func (s *stringSet) add(items ...string) {
+	for _, item := range items {
+		if _, ok := s.seen[item]; ok || item == "" {
+			continue
+		}
+		s.seen[item] = struct{}{}
+		s.items = append(s.items, item)
+	}
+}
+
+// list returns the items in insertion order.
+func (s *stringSet) list() []string {
+	return append(make([]string, 0, len(s.items)), s.items...)
+}
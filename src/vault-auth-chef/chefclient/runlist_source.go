@@ -0,0 +1,220 @@
+package chefclient
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/go-chef/chef"
+	"github.com/pkg/errors"
+)
+
+const (
+	// runListMergeUnion merges the roles and recipes of every source.
+	runListMergeUnion = "union"
+	// runListMergeFirstNonEmpty uses the first source with a non-empty
+	// run_list.
+	runListMergeFirstNonEmpty = "first_non_empty"
+	// runListMergeOverride lets each source with a non-empty run_list replace
+	// the run_list of the sources before it.
+	runListMergeOverride = "override"
+)
+
+// runList is the run_list and environment of a client as discovered by a
+// run_list source. Empty name and env leave the node object values.
+type runList struct {
+	roles   []string
+	recipes []string
+	env     string
+	name    string
+
+	// fields are extra policy templates and token metadata.
+	fields map[string]string
+
+	// dataBag is the raw data bag item the run_list was read from, if any.
+	dataBag []byte
+}
+
+// empty reports whether the run_list has neither roles nor recipes.
+func (r *runList) empty() bool {
+	return len(r.roles) == 0 && len(r.recipes) == 0
+}
+
+// runListSource discovers the run_list of a client.
+type runListSource interface {
+	// validate checks the configuration needed by the source.
+	validate(config *config) error
+
+	// runList returns the run_list of the client, or nil if the source has
+	// nothing for it.
+	runList(b *backend, config *config, c *chef.Client, client string, node *chefNode) (*runList, error)
+}
+
+// runListSources is the registry of run_list sources by name.
+var runListSources = map[string]runListSource{}
+
+// registerRunListSource makes a run_list source available to run_list_src.
+func registerRunListSource(name string, src runListSource) {
+	runListSources[name] = src
+}
+
+func init() {
+	registerRunListSource("node", nodeRunListSource{})
+	registerRunListSource("data", dataRunListSource{})
+}
+
+// parseRunListSources splits the comma-separated run_list_src value and
+// checks every source is registered.
+func parseRunListSources(value string) ([]string, error) {
+	names := make([]string, 0)
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if _, ok := runListSources[name]; !ok {
+			known := make([]string, 0, len(runListSources))
+			for k := range runListSources {
+				known = append(known, "'"+k+"'")
+			}
+			sort.Strings(known)
+			return nil, fmt.Errorf("unknown source %q, only %s are allowed", name, strings.Join(known, ", "))
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// discoverRunList asks the configured sources, in order, for the client's
+// run_list and merges their answers with the configured strategy. The
+// run_list is empty when no source has anything for the client.
+func (b *backend) discoverRunList(config *config, c *chef.Client, client string, node *chefNode) (*runList, error) {
+	names, err := parseRunListSources(config.RunListSrc)
+	if err != nil {
+		return nil, err
+	}
+
+	var merged *runList
+	for _, name := range names {
+		result, err := runListSources[name].runList(b, config, c, client, node)
+		if err != nil {
+			return nil, errors.Wrapf(err, "run_list source %q", name)
+		}
+		if result == nil {
+			b.logger.Debug(fmt.Sprintf("Client %s has no run_list in source %s", client, name))
+			continue
+		}
+		merged = mergeRunLists(config.RunListMerge, merged, result)
+		if config.RunListMerge == runListMergeFirstNonEmpty && !merged.empty() {
+			break
+		}
+	}
+	// A client no source knows has an empty run_list, it is still granted
+	// the policies which do not depend on it
+	if merged == nil {
+		b.logger.Debug(fmt.Sprintf("Client %s has no run_list in any source", client))
+		merged = &runList{fields: make(map[string]string)}
+	}
+	return merged, nil
+}
+
+// mergeRunLists merges the run_list of the next source into the run_list of
+// the previous ones. Extra fields are always merged, the first source setting
+// the environment and name wins except with override.
+func mergeRunLists(strategy string, prev, next *runList) *runList {
+	if prev == nil {
+		return next
+	}
+
+	merged := &runList{
+		roles:   prev.roles,
+		recipes: prev.recipes,
+		env:     prev.env,
+		name:    prev.name,
+		fields:  make(map[string]string, len(prev.fields)+len(next.fields)),
+		dataBag: prev.dataBag,
+	}
+	if merged.dataBag == nil {
+		merged.dataBag = next.dataBag
+	}
+	for k, v := range prev.fields {
+		merged.fields[k] = v
+	}
+	for k, v := range next.fields {
+		if _, ok := merged.fields[k]; !ok || strategy == runListMergeOverride {
+			merged.fields[k] = v
+		}
+	}
+
+	switch strategy {
+	case runListMergeOverride:
+		if !next.empty() {
+			merged.roles, merged.recipes = next.roles, next.recipes
+		}
+		if next.env != "" {
+			merged.env = next.env
+		}
+		if next.name != "" {
+			merged.name = next.name
+		}
+	case runListMergeFirstNonEmpty:
+		if prev.empty() {
+			merged.roles, merged.recipes = next.roles, next.recipes
+		}
+		if merged.env == "" {
+			merged.env = next.env
+		}
+		if merged.name == "" {
+			merged.name = next.name
+		}
+	default:
+		roles := newStringSet(prev.roles...)
+		roles.add(next.roles...)
+		recipes := newStringSet(prev.recipes...)
+		recipes.add(next.recipes...)
+		merged.roles, merged.recipes = roles.list(), recipes.list()
+		if merged.env == "" {
+			merged.env = next.env
+		}
+		if merged.name == "" {
+			merged.name = next.name
+		}
+	}
+	return merged
+}
+
+// nodeRunListSource reads the run_list of the node object.
+type nodeRunListSource struct{}
+
+func (nodeRunListSource) validate(config *config) error {
+	return nil
+}
+
+func (nodeRunListSource) runList(b *backend, config *config, c *chef.Client, client string, node *chefNode) (*runList, error) {
+	roles, recipes := getRolesFromNode(node.Node, client, c, b)
+	return &runList{roles: roles, recipes: recipes}, nil
+}
+
+// dataRunListSource reads the run_list, environment and name of the client's
+// data bag item.
+type dataRunListSource struct{}
+
+func (dataRunListSource) validate(config *config) error {
+	if len(config.DataBags) == 0 {
+		return errors.New("data_bags must be set")
+	}
+	if config.DataBagItem == "" {
+		return errors.New("data_bag_item must be set")
+	}
+	if _, err := dataBagItemName(config.DataBagItem, "node.example.com"); err != nil {
+		return errors.Wrap(err, "bad data_bag_item")
+	}
+	if err := validateDataBagFields(config.DataBagFields); err != nil {
+		return errors.Wrap(err, "bad data_bag_fields")
+	}
+	return nil
+}
+
+func (dataRunListSource) runList(b *backend, config *config, c *chef.Client, client string, node *chefNode) (*runList, error) {
+	return getRolesFromData(config, client, c, b)
+}
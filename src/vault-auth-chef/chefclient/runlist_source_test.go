@@ -0,0 +1,75 @@
+package chefclient
+
+import (
+	"testing"
+
+	"github.com/go-chef/chef"
+	log "github.com/hashicorp/go-hclog"
+)
+
+// staticRunListSource returns a fixed run_list, nil when the client is
+// unknown.
+type staticRunListSource struct{ result *runList }
+
+func (staticRunListSource) validate(config *config) error {
+	return nil
+}
+
+func (s staticRunListSource) runList(b *backend, config *config, c *chef.Client, client string, node *chefNode) (*runList, error) {
+	return s.result, nil
+}
+
+func TestDiscoverRunList(t *testing.T) {
+	registerRunListSource("test-unknown", staticRunListSource{})
+	registerRunListSource("test-web", staticRunListSource{&runList{roles: []string{"web"}, env: "production"}})
+	registerRunListSource("test-db", staticRunListSource{&runList{roles: []string{"db"}, recipes: []string{"mysql::default"}}})
+	defer func() {
+		delete(runListSources, "test-unknown")
+		delete(runListSources, "test-web")
+		delete(runListSources, "test-db")
+	}()
+
+	cases := []struct {
+		name    string
+		src     string
+		merge   string
+		roles   []string
+		recipes []string
+		env     string
+	}{
+		{"unknown client", "test-unknown", runListMergeUnion, nil, nil, ""},
+		{"unknown client in every source", "test-unknown,test-unknown", runListMergeOverride, nil, nil, ""},
+		{"unknown sources are skipped", "test-unknown,test-web", runListMergeUnion, []string{"web"}, nil, "production"},
+		{"union", "test-web,test-db", runListMergeUnion, []string{"web", "db"}, []string{"mysql::default"}, "production"},
+		{"first non-empty", "test-web,test-db", runListMergeFirstNonEmpty, []string{"web"}, nil, "production"},
+		{"override", "test-web,test-db", runListMergeOverride, []string{"db"}, []string{"mysql::default"}, "production"},
+	}
+
+	b := &backend{logger: log.NewNullLogger()}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := &config{RunListSrc: tc.src, RunListMerge: tc.merge}
+			got, err := b.discoverRunList(config, nil, "web-01", nil)
+			if err != nil {
+				t.Fatalf("expected no error, got %s", err)
+			}
+			if !equalStrings(got.roles, tc.roles) || !equalStrings(got.recipes, tc.recipes) || got.env != tc.env {
+				t.Fatalf("expected roles %v recipes %v env %q, got roles %v recipes %v env %q",
+					tc.roles, tc.recipes, tc.env, got.roles, got.recipes, got.env)
+			}
+		})
+	}
+}
+
+// equalStrings compares string lists, nil and empty being equal.
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
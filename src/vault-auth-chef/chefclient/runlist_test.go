@@ -0,0 +1,25 @@
+package chefclient
+
+import (
+	"testing"
+
+	log "github.com/hashicorp/go-hclog"
+)
+
+// TestExpandRunListServerRoleNames checks role names which are not valid
+// Chef role names are never requested: the client is nil and would panic.
+func TestExpandRunListServerRoleNames(t *testing.T) {
+	b := &backend{logger: log.NewNullLogger()}
+	roles := []string{"../clients/web-01", "web/..", "..", ".", "web?x", "web%2F..", "web 01", ""}
+
+	expanded, recipes, err := expandRunListServer(nil, "production", roles, []string{"nginx::default"}, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expanded) != len(roles) {
+		t.Fatalf("expected %v, got %v", roles, expanded)
+	}
+	if len(recipes) != 1 || recipes[0] != "nginx::default" {
+		t.Fatalf("expected the run_list recipes only, got %v", recipes)
+	}
+}
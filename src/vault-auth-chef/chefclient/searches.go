@@ -0,0 +1,367 @@
+package chefclient
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-chef/chef"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/pkg/errors"
+)
+
+const (
+	// searchesPrefix is the storage prefix of search mappings.
+	searchesPrefix = "searches/"
+
+	// searchRows is the page size of search requests.
+	searchRows = 1000
+)
+
+// searchEntry maps the nodes returned by a Chef search query to a series of
+// policies.
+type searchEntry struct {
+	Policies []string `json:"policy" structs:"policy"`
+	Query    string   `json:"query" structs:"query"`
+
+	// tokenSettings override the token settings of matching nodes.
+	tokenSettings
+}
+
+// searchResult is the cached set of node names returned by a search query.
+type searchResult struct {
+	nodes   map[string]struct{}
+	fetched time.Time
+}
+
+// Search returns the named search mapping from the storage backend, or nil if
+// it does not exist.
+func (b *backend) Search(ctx context.Context, s logical.Storage, name string) (*searchEntry, error) {
+	entry, err := s.Get(ctx, searchesPrefix+strings.ToLower(name))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get search %q from storage", name)
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var result searchEntry
+	if err := entry.DecodeJSON(&result); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode search %q", name)
+	}
+
+	return &result, nil
+}
+
+// searchesPolicies runs every search mapping, or uses its cached results, and
+// returns the policies of the searches the node was found by along with
+// their names. The token settings of those searches restrict settings. A
+// search the Chef server fails to run is skipped, so one bad query does not
+// refuse every login.
+func (b *backend) searchesPolicies(ctx context.Context, s logical.Storage, config *config, c *chef.Client, nodeName string, settings *tokenSettings) ([]string, []string, error) {
+	names, err := s.List(ctx, searchesPrefix)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to list searches")
+	}
+
+	policies := make([]string, 0)
+	matched := make([]string, 0)
+	for _, name := range names {
+		search, err := b.Search(ctx, s, name)
+		if err != nil {
+			return nil, nil, err
+		}
+		if search == nil {
+			continue
+		}
+
+		nodes, err := b.searchNodes(c, search.Query, config.SearchRefresh)
+		if err != nil {
+			b.logger.Warn(fmt.Sprintf("Skipping search %s which failed to run: %s", name, err.Error()))
+			continue
+		}
+		if _, ok := nodes[nodeName]; ok {
+			if err := settings.restrict(&search.tokenSettings); err != nil {
+				return nil, nil, errors.Wrapf(err, "search %q", name)
+			}
+			matched = append(matched, name)
+			policies = append(policies, search.Policies...)
+		}
+	}
+	return policies, matched, nil
+}
+
+// searchNodes returns the names of the nodes matching the query, running the
+// search only when the cached results are older than refresh. The lock is not
+// held while the search runs, concurrent logins may run the same search.
+func (b *backend) searchNodes(c *chef.Client, query string, refresh time.Duration) (map[string]struct{}, error) {
+	b.searchLock.Lock()
+	cached, ok := b.searchCache[query]
+	b.searchLock.Unlock()
+	if ok && time.Since(cached.fetched) < refresh {
+		return cached.nodes, nil
+	}
+
+	fetched := time.Now()
+	nodes, err := searchNodeNames(c, query)
+	if err != nil {
+		return nil, err
+	}
+	b.logger.Debug(fmt.Sprintf("Search %q returned %d nodes", query, len(nodes)))
+
+	b.searchLock.Lock()
+	defer b.searchLock.Unlock()
+
+	// Keep the results of a search which started later
+	if cached, ok := b.searchCache[query]; !ok || cached.fetched.Before(fetched) {
+		b.searchCache[query] = &searchResult{
+			nodes:   nodes,
+			fetched: fetched,
+		}
+	}
+	return nodes, nil
+}
+
+// resetSearchCache drops all cached search results.
+func (b *backend) resetSearchCache() {
+	b.searchLock.Lock()
+	defer b.searchLock.Unlock()
+
+	b.searchCache = make(map[string]*searchResult)
+}
+
+// searchNodeNames runs a partial search on the node index, returning only the
+// node names, and pages through all results.
+func searchNodeNames(c *chef.Client, query string) (map[string]struct{}, error) {
+	body := map[string]interface{}{
+		"name": []string{"name"},
+	}
+
+	nodes := make(map[string]struct{})
+	for start := 0; ; start += searchRows {
+		var res struct {
+			Total int `json:"total"`
+			Rows  []struct {
+				Data struct {
+					Name string `json:"name"`
+				} `json:"data"`
+			} `json:"rows"`
+		}
+
+		path := fmt.Sprintf("search/node?q=%s&rows=%d&start=%d", url.QueryEscape(query), searchRows, start)
+		if err := chefRequest(c, "POST", path, body, &res); err != nil {
+			return nil, err
+		}
+
+		for _, row := range res.Rows {
+			nodes[row.Data.Name] = struct{}{}
+		}
+		if len(res.Rows) == 0 || start+searchRows >= res.Total {
+			return nodes, nil
+		}
+	}
+}
+
+// searchQueryParser checks the structure of search queries before they are
+// stored, so that an unbalanced or truncated query is refused at write time.
+// It accepts exactly this subset of the Lucene syntax Chef search uses:
+//
+//	query  = clause { [ binop ] clause }
+//	clause = [ unop ] ( "(" query ")" | term ":" value )
+//	value  = phrase | range | "(" [ unop ] value { [ binop ] [ unop ] value } ")" | term
+//	range  = ( "[" | "{" ) term "TO" term ( "]" | "}" )
+//	phrase = '"' { any character but '"' | "\" any character } '"'
+//	term   = ( char | "\" any character ) { char | "\" any character }
+//	binop  = "AND" | "OR" | "&&" | "||"
+//	unop   = "NOT" | "!" | "+" | "-"
+//
+// where char is any character but space, tab, CR, LF and :()[]{}". Spaces
+// may separate clauses, operators, values of a group and range bounds, not
+// a term from its ':' or value. AND, OR, NOT and TO are operators only when
+// followed by a space or '(', e.g. NOTES:x is a clause on the NOTES field.
+// Wildcards, fuzzy and boost suffixes and field names are plain term
+// characters, left to the Chef server to interpret. The query is sent
+// URL-escaped and never templated, so it cannot carry anything but a query.
+type searchQueryParser struct {
+	s   string
+	pos int
+}
+
+// validateSearchQuery checks the syntax of a search query.
+func validateSearchQuery(query string) error {
+	p := &searchQueryParser{s: query}
+	return p.parseQuery(false)
+}
+
+func (p *searchQueryParser) skipSpace() {
+	for p.pos < len(p.s) && isSearchSpace(p.s[p.pos]) {
+		p.pos++
+	}
+}
+
+// peek returns the next character, or 0 at the end of the query.
+func (p *searchQueryParser) peek() byte {
+	if p.pos >= len(p.s) {
+		return 0
+	}
+	return p.s[p.pos]
+}
+
+// consume skips the next operator if it is any of the given ones. Word
+// operators must be followed by a space or a group.
+func (p *searchQueryParser) consume(ops ...string) bool {
+	for _, op := range ops {
+		if !strings.HasPrefix(p.s[p.pos:], op) {
+			continue
+		}
+		end := p.pos + len(op)
+		if op[0] >= 'A' && op[0] <= 'Z' && end < len(p.s) && !isSearchSpace(p.s[end]) && p.s[end] != '(' {
+			continue
+		}
+		p.pos = end
+		p.skipSpace()
+		return true
+	}
+	return false
+}
+
+// parseQuery parses clauses up to the end of the query, or up to the closing
+// parenthesis of a group.
+func (p *searchQueryParser) parseQuery(group bool) error {
+	start := p.pos
+	for clauses := 0; ; clauses++ {
+		p.skipSpace()
+		switch c := p.peek(); {
+		case c == 0 && group:
+			return fmt.Errorf("missing ')' for the group at offset %d", start-1)
+		case c == ')' && !group:
+			return fmt.Errorf("unexpected ')' at offset %d", p.pos)
+		case c == 0 || c == ')':
+			if clauses == 0 {
+				return fmt.Errorf("empty query at offset %d", start)
+			}
+			return nil
+		}
+
+		if clauses > 0 {
+			p.consume("AND", "OR", "&&", "||")
+		}
+		if err := p.parseClause(); err != nil {
+			return err
+		}
+	}
+}
+
+func (p *searchQueryParser) parseClause() error {
+	p.consume("NOT", "!", "+", "-")
+
+	if p.peek() == '(' {
+		p.pos++
+		if err := p.parseQuery(true); err != nil {
+			return err
+		}
+		p.pos++
+		return nil
+	}
+
+	start := p.pos
+	if field := p.parseTerm(); field == "" {
+		return fmt.Errorf("expected a field at offset %d", start)
+	}
+	if p.peek() != ':' {
+		return fmt.Errorf("expected field:value at offset %d", start)
+	}
+	p.pos++
+	return p.parseValue()
+}
+
+func (p *searchQueryParser) parseValue() error {
+	start := p.pos
+	switch p.peek() {
+	case '"':
+		for p.pos++; p.pos < len(p.s) && p.s[p.pos] != '"'; p.pos++ {
+			if p.s[p.pos] == '\\' {
+				p.pos++
+			}
+		}
+		if p.pos >= len(p.s) {
+			return fmt.Errorf("unterminated phrase at offset %d", start)
+		}
+		p.pos++
+		return nil
+	case '[', '{':
+		p.pos++
+		p.skipSpace()
+		if p.parseTerm() == "" {
+			return fmt.Errorf("expected the lower bound of the range at offset %d", start)
+		}
+		p.skipSpace()
+		if !p.consume("TO") {
+			return fmt.Errorf("expected TO in the range at offset %d", start)
+		}
+		if p.parseTerm() == "" {
+			return fmt.Errorf("expected the upper bound of the range at offset %d", start)
+		}
+		p.skipSpace()
+		if c := p.peek(); c != ']' && c != '}' {
+			return fmt.Errorf("missing end of the range at offset %d", start)
+		}
+		p.pos++
+		return nil
+	case '(':
+		p.pos++
+		for values := 0; ; values++ {
+			p.skipSpace()
+			switch p.peek() {
+			case 0:
+				return fmt.Errorf("missing ')' for the group at offset %d", start)
+			case ')':
+				if values == 0 {
+					return fmt.Errorf("empty group at offset %d", start)
+				}
+				p.pos++
+				return nil
+			}
+			if values > 0 {
+				p.consume("AND", "OR", "&&", "||")
+			}
+			p.consume("NOT", "!", "+", "-")
+			if err := p.parseValue(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if p.parseTerm() == "" {
+		return fmt.Errorf("expected a value at offset %d", start)
+	}
+	return nil
+}
+
+// parseTerm parses a field name or a term, skipping escaped characters, and
+// returns it. It is empty when the next character cannot start a term.
+func (p *searchQueryParser) parseTerm() string {
+	start := p.pos
+	for p.pos < len(p.s) && !isSearchSpecial(p.s[p.pos]) {
+		if p.s[p.pos] == '\\' {
+			p.pos++
+			if p.pos == len(p.s) {
+				return ""
+			}
+		}
+		p.pos++
+	}
+	return p.s[start:p.pos]
+}
+
+// isSearchSpace reports whether c separates the clauses of a query.
+func isSearchSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+// isSearchSpecial reports whether c ends a term unless it is escaped.
+func isSearchSpecial(c byte) bool {
+	return isSearchSpace(c) || strings.IndexByte(`:()[]{}"`, c) >= 0
+}
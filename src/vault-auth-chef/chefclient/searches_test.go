@@ -0,0 +1,74 @@
+package chefclient
+
+import (
+	"testing"
+)
+
+func TestValidateSearchQuery(t *testing.T) {
+	cases := []struct {
+		query string
+		ok    bool
+	}{
+		{`*:*`, true},
+		{`chef_environment:prod`, true},
+		{`chef_environment:prod AND recipes:nginx*`, true},
+		{`chef_environment:prod recipes:nginx`, true},
+		{`chef_environment:prod && (roles:web || roles:api)`, true},
+		{`NOT chef_environment:prod`, true},
+		{`-chef_environment:prod +roles:web !tags:old`, true},
+		{`recipes:nginx\:\:default`, true},
+		{`fqdn:web-0?.example.com`, true},
+		{`name:"web 01"`, true},
+		{`name:"web \"01\""`, true},
+		{`roles:(web OR api)`, true},
+		{`roles:(web api NOT db)`, true},
+		{`memory_total:[1000 TO 5000}`, true},
+		{`ohai_time:{* TO 1500000000]`, true},
+		{`NOTES:x`, true},
+		{`(roles:web)AND(roles:api)`, true},
+		{`roles:web~ fqdn:web^2`, true},
+		{`memory_total:[ 1000 TO 5000 ]`, true},
+		{`roles:( web OR api )`, true},
+		{`roles:(NOT db)`, true},
+		{`roles:web ANDroles:api`, true},
+		{"roles:web\tAND\nroles:api", true},
+
+		{``, false},
+		{`   `, false},
+		{`web`, false},
+		{`:web`, false},
+		{`roles:`, false},
+		{`roles: web`, false},
+		{`roles:web AND`, false},
+		{`roles:web OR OR roles:api`, false},
+		{`NOT`, false},
+		{`recipes:nginx::default`, false},
+		{`recipes:nginx\`, false},
+		{`name:"web`, false},
+		{`(roles:web`, false},
+		{`roles:web)`, false},
+		{`()`, false},
+		{`roles:()`, false},
+		{`roles:(web`, false},
+		{`memory_total:[1000 5000]`, false},
+		{`memory_total:[1000 TO]`, false},
+		{`memory_total:[TO 5000]`, false},
+		{`memory_total:[1000 TO 5000`, false},
+		{`memory_total:[1000 TO5000]`, false},
+		{`roles :web`, false},
+		{`roles:web OR`, false},
+		{`roles:"web" "api"`, false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.query, func(t *testing.T) {
+			err := validateSearchQuery(tc.query)
+			if tc.ok && err != nil {
+				t.Fatalf("expected no error, got %s", err)
+			}
+			if !tc.ok && err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package chefclient
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/go-secure-stdlib/parseutil"
+	"github.com/tidwall/gjson"
+)
+
+// parseNodeStaleness parses the env=duration pairs of the per-environment
+// staleness limits.
+func parseNodeStaleness(pairs map[string]string) (map[string]time.Duration, error) {
+	result := make(map[string]time.Duration, len(pairs))
+	for env, value := range pairs {
+		staleness, err := parseutil.ParseDurationSecond(value)
+		if err != nil {
+			return nil, fmt.Errorf("bad duration %q for environment %q", value, env)
+		}
+		if staleness < 0 {
+			return nil, fmt.Errorf("negative duration for environment %q", env)
+		}
+		result[env] = staleness
+	}
+	return result, nil
+}
+
+// checkNodeStaleness refuses nodes whose last chef-client run, reported by
+// Ohai in automatic.ohai_time, is older than the staleness limit of their
+// environment. A zero limit disables the check.
+func checkNodeStaleness(config *config, node *chefNode, now time.Time) error {
+	limit := config.MaxNodeStaleness
+	if staleness, ok := config.EnvNodeStaleness[node.Environment]; ok {
+		limit = staleness
+	}
+	if limit == 0 {
+		return nil
+	}
+
+	ohaiTime := gjson.GetBytes(node.raw, "automatic.ohai_time")
+	if ohaiTime.Type != gjson.Number {
+		return fmt.Errorf("node %s has no automatic.ohai_time, chef-client never ran", node.Name)
+	}
+	lastRun := time.Unix(0, int64(ohaiTime.Float()*float64(time.Second)))
+	if age := now.Sub(lastRun); age > limit {
+		return fmt.Errorf("node %s last ran chef-client at %s, %s ago, more than the %s allowed in environment %s",
+			node.Name, lastRun.UTC().Format(time.RFC3339), age.Truncate(time.Second), limit, node.Environment)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package chefclient
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-chef/chef"
+)
+
+func TestCheckNodeStaleness(t *testing.T) {
+	now := time.Date(2009, 1, 1, 12, 0, 0, 0, time.UTC)
+	node := func(env, ohaiTime string) *chefNode {
+		raw := `{"automatic": {}}`
+		if ohaiTime != "" {
+			raw = fmt.Sprintf(`{"automatic": {"ohai_time": %s}}`, ohaiTime)
+		}
+		return &chefNode{Node: chef.Node{Name: "web-01", Environment: env}, raw: []byte(raw)}
+	}
+	ranAgo := func(d time.Duration) string {
+		return fmt.Sprintf("%.3f", float64(now.Add(-d).UnixNano())/float64(time.Second))
+	}
+
+	config := &config{
+		MaxNodeStaleness: 24 * time.Hour,
+		EnvNodeStaleness: map[string]time.Duration{
+			"production": time.Hour,
+			"lab":        0,
+		},
+	}
+
+	cases := []struct {
+		name string
+		node *chefNode
+		ok   bool
+	}{
+		{"recent run", node("staging", ranAgo(time.Hour)), true},
+		{"stale run", node("staging", ranAgo(25*time.Hour)), false},
+		{"exactly at the limit", node("staging", ranAgo(24*time.Hour)), true},
+		{"just over the limit", node("staging", ranAgo(24*time.Hour+time.Second)), false},
+		{"fractional ohai_time", node("staging", ranAgo(24*time.Hour-time.Millisecond)), true},
+		{"missing ohai_time", node("staging", ""), false},
+		{"string ohai_time", node("staging", `"1230811200"`), false},
+		{"per environment limit", node("production", ranAgo(2*time.Hour)), false},
+		{"within the per environment limit", node("production", ranAgo(30*time.Minute)), true},
+		{"per environment limit exactly", node("production", ranAgo(time.Hour)), true},
+		{"environment override of 0", node("lab", ranAgo(365*24*time.Hour)), true},
+		{"environment override of 0 without ohai_time", node("lab", ""), true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := checkNodeStaleness(config, tc.node, now)
+			if tc.ok && err != nil {
+				t.Fatalf("expected no error, got %s", err)
+			}
+			if !tc.ok && err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+func TestCheckNodeStalenessDisabled(t *testing.T) {
+	now := time.Date(2009, 1, 1, 12, 0, 0, 0, time.UTC)
+	node := &chefNode{Node: chef.Node{Name: "web-01", Environment: "staging"}, raw: []byte(`{"automatic": {}}`)}
+
+	// Without limits, nodes which never ran chef-client log in
+	if err := checkNodeStaleness(&config{}, node, now); err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+
+	// A per environment limit enables the check without a global one
+	config := &config{EnvNodeStaleness: map[string]time.Duration{"staging": time.Hour}}
+	if err := checkNodeStaleness(config, node, now); err == nil {
+		t.Fatal("expected an error")
+	}
+}
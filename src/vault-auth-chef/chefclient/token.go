@@ -0,0 +1,339 @@
+package chefclient
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/hashicorp/go-secure-stdlib/parseutil"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/pkg/errors"
+)
+
+const (
+	tokenTypeDefault = "default"
+	tokenTypeService = "service"
+	tokenTypeBatch   = "batch"
+)
+
+// tokenSettings are the token settings a mapping can override. Zero values
+// leave the mount ones unchanged.
+type tokenSettings struct {
+	TTL             time.Duration `json:"ttl,omitempty"`
+	MaxTTL          time.Duration `json:"max_ttl,omitempty"`
+	Period          time.Duration `json:"period,omitempty"`
+	ExplicitMaxTTL  time.Duration `json:"explicit_max_ttl,omitempty"`
+	NumUses         int           `json:"num_uses,omitempty"`
+	BoundCIDRs      []string      `json:"bound_cidrs,omitempty"`
+	TokenType       string        `json:"token_type,omitempty"`
+	NoDefaultPolicy bool          `json:"no_default_policy,omitempty"`
+}
+
+// tokenSettingsFields returns the schema of the token settings of mappings.
+func tokenSettingsFields() map[string]*framework.FieldSchema {
+	return map[string]*framework.FieldSchema{
+		"ttl": &framework.FieldSchema{
+			Type:        framework.TypeDurationSecond,
+			Description: "Duration after which authentication will expire.",
+		},
+
+		"max_ttl": &framework.FieldSchema{
+			Type:        framework.TypeDurationSecond,
+			Description: "Maximum duration after which authentication will expire.",
+		},
+
+		"period": &framework.FieldSchema{
+			Type:        framework.TypeDurationSecond,
+			Description: "If set, tokens are periodic and renewable for this period forever.",
+		},
+
+		"explicit_max_ttl": &framework.FieldSchema{
+			Type:        framework.TypeDurationSecond,
+			Description: "Hard limit of the token lifetime, renewals included.",
+		},
+
+		"num_uses": &framework.FieldSchema{
+			Type:        framework.TypeInt,
+			Description: "Number of times the token can be used, unlimited if 0.",
+		},
+
+		"bound_cidrs": &framework.FieldSchema{
+			Type:        framework.TypeCommaStringSlice,
+			Description: "Comma-separated list of CIDR blocks logins and tokens are allowed from.",
+		},
+
+		"token_type": &framework.FieldSchema{
+			Type:        framework.TypeString,
+			Description: "Type of the tokens, 'service', 'batch' or 'default'.",
+		},
+
+		"no_default_policy": &framework.FieldSchema{
+			Type:        framework.TypeBool,
+			Description: "Leave the 'default' policy out of the tokens.",
+		},
+	}
+}
+
+// withTokenSettings adds the token settings to the fields of a mapping path.
+func withTokenSettings(fields map[string]*framework.FieldSchema) map[string]*framework.FieldSchema {
+	for name, schema := range tokenSettingsFields() {
+		fields[name] = schema
+	}
+	return fields
+}
+
+// parseTokenSettings reads the token settings of a mapping write.
+func parseTokenSettings(data *framework.FieldData) (*tokenSettings, error) {
+	settings := &tokenSettings{
+		TTL:             time.Duration(data.Get("ttl").(int)) * time.Second,
+		MaxTTL:          time.Duration(data.Get("max_ttl").(int)) * time.Second,
+		Period:          time.Duration(data.Get("period").(int)) * time.Second,
+		ExplicitMaxTTL:  time.Duration(data.Get("explicit_max_ttl").(int)) * time.Second,
+		NumUses:         data.Get("num_uses").(int),
+		BoundCIDRs:      data.Get("bound_cidrs").([]string),
+		TokenType:       data.Get("token_type").(string),
+		NoDefaultPolicy: data.Get("no_default_policy").(bool),
+	}
+	if err := settings.validate(); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+// tokenSettingsFromMap reads the token settings stored in a map/* entry.
+func tokenSettingsFromMap(m map[string]interface{}) (*tokenSettings, error) {
+	var settings tokenSettings
+	var err error
+	durations := map[string]*time.Duration{
+		"ttl":              &settings.TTL,
+		"max_ttl":          &settings.MaxTTL,
+		"period":           &settings.Period,
+		"explicit_max_ttl": &settings.ExplicitMaxTTL,
+	}
+	for key, d := range durations {
+		if raw, ok := m[key]; ok {
+			if *d, err = parseutil.ParseDurationSecond(raw); err != nil {
+				return nil, errors.Wrapf(err, "bad value for %s", key)
+			}
+		}
+	}
+	if raw, ok := m["num_uses"]; ok {
+		numUses, err := parseutil.ParseInt(raw)
+		if err != nil {
+			return nil, errors.Wrap(err, "bad value for num_uses")
+		}
+		settings.NumUses = int(numUses)
+	}
+	if raw, ok := m["bound_cidrs"]; ok {
+		if settings.BoundCIDRs, err = parseutil.ParseCommaStringSlice(raw); err != nil {
+			return nil, errors.Wrap(err, "bad value for bound_cidrs")
+		}
+	}
+	if raw, ok := m["token_type"]; ok {
+		if settings.TokenType, err = parseutil.ParseString(raw); err != nil {
+			return nil, errors.Wrap(err, "bad value for token_type")
+		}
+	}
+	if raw, ok := m["no_default_policy"]; ok {
+		if settings.NoDefaultPolicy, err = parseutil.ParseBool(raw); err != nil {
+			return nil, errors.Wrap(err, "bad value for no_default_policy")
+		}
+	}
+	if err := settings.validate(); err != nil {
+		return nil, err
+	}
+	return &settings, nil
+}
+
+// validate checks the settings are consistent, and normalizes the default
+// token type to the empty string.
+func (s *tokenSettings) validate() error {
+	if s.TTL < 0 || s.MaxTTL < 0 || s.Period < 0 || s.ExplicitMaxTTL < 0 {
+		return errors.New("durations cannot be negative")
+	}
+	if s.MaxTTL > 0 && s.TTL > s.MaxTTL {
+		return errors.New("'ttl' cannot be greater than 'max_ttl'")
+	}
+	if s.NumUses < 0 {
+		return errors.New("'num_uses' cannot be negative")
+	}
+	if err := validateCIDRs(s.BoundCIDRs); err != nil {
+		return errors.Wrap(err, "bad value for 'bound_cidrs'")
+	}
+	if s.TokenType == tokenTypeDefault {
+		s.TokenType = ""
+	}
+	return validateTokenType(s.TokenType, s.Period, s.NumUses)
+}
+
+// fields returns the settings which are set, durations in seconds, as
+// stored in map/* entries and returned by reads.
+func (s *tokenSettings) fields() map[string]interface{} {
+	fields := make(map[string]interface{})
+	if s.TTL > 0 {
+		fields["ttl"] = int64(s.TTL / time.Second)
+	}
+	if s.MaxTTL > 0 {
+		fields["max_ttl"] = int64(s.MaxTTL / time.Second)
+	}
+	if s.Period > 0 {
+		fields["period"] = int64(s.Period / time.Second)
+	}
+	if s.ExplicitMaxTTL > 0 {
+		fields["explicit_max_ttl"] = int64(s.ExplicitMaxTTL / time.Second)
+	}
+	if s.NumUses > 0 {
+		fields["num_uses"] = s.NumUses
+	}
+	if len(s.BoundCIDRs) > 0 {
+		fields["bound_cidrs"] = s.BoundCIDRs
+	}
+	if s.TokenType != "" {
+		fields["token_type"] = s.TokenType
+	}
+	if s.NoDefaultPolicy {
+		fields["no_default_policy"] = true
+	}
+	return fields
+}
+
+// restrict merges o into s, keeping the most restrictive of both: the
+// shortest durations and use count, the intersection of the bound CIDRs,
+// batch over service tokens, and no default policy if either leaves it out.
+func (s *tokenSettings) restrict(o *tokenSettings) error {
+	s.TTL = minDuration(s.TTL, o.TTL)
+	s.MaxTTL = minDuration(s.MaxTTL, o.MaxTTL)
+	s.Period = minDuration(s.Period, o.Period)
+	s.ExplicitMaxTTL = minDuration(s.ExplicitMaxTTL, o.ExplicitMaxTTL)
+	if o.NumUses > 0 && (s.NumUses == 0 || o.NumUses < s.NumUses) {
+		s.NumUses = o.NumUses
+	}
+
+	if len(s.BoundCIDRs) > 0 && len(o.BoundCIDRs) > 0 {
+		s.BoundCIDRs = intersectCIDRs(s.BoundCIDRs, o.BoundCIDRs)
+		if len(s.BoundCIDRs) == 0 {
+			return errors.New("the bound CIDRs of the matched mappings do not overlap")
+		}
+	} else if len(o.BoundCIDRs) > 0 {
+		s.BoundCIDRs = o.BoundCIDRs
+	}
+
+	if s.TokenType != tokenTypeBatch && o.TokenType != "" {
+		s.TokenType = o.TokenType
+	}
+	s.NoDefaultPolicy = s.NoDefaultPolicy || o.NoDefaultPolicy
+	return nil
+}
+
+// validateTokenType checks the token type, batch tokens can neither be
+// periodic nor limited in uses.
+func validateTokenType(tokenType string, period time.Duration, numUses int) error {
+	switch tokenType {
+	case "", tokenTypeDefault, tokenTypeService:
+		return nil
+	case tokenTypeBatch:
+		if period > 0 {
+			return errors.New("batch tokens cannot be periodic")
+		}
+		if numUses > 0 {
+			return errors.New("batch tokens cannot be limited in uses")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown token type %q, only 'service', 'batch' or 'default' are allowed", tokenType)
+	}
+}
+
+// logicalTokenType converts the token type setting to the Vault one.
+func logicalTokenType(tokenType string) logical.TokenType {
+	switch tokenType {
+	case tokenTypeService:
+		return logical.TokenTypeService
+	case tokenTypeBatch:
+		return logical.TokenTypeBatch
+	default:
+		return logical.TokenTypeDefault
+	}
+}
+
+// validateCIDRs checks every item is a valid CIDR block.
+func validateCIDRs(cidrs []string) error {
+	for _, cidr := range cidrs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("invalid CIDR %q", cidr)
+		}
+	}
+	return nil
+}
+
+// addrInCIDRs reports whether the address is within any of the CIDR blocks.
+func addrInCIDRs(addr net.IP, cidrs []string) bool {
+	for _, cidr := range cidrs {
+		if _, block, err := net.ParseCIDR(cidr); err == nil && block.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// intersectCIDRs returns the blocks within both lists of CIDR blocks. Two
+// blocks either nest or do not overlap, so their intersection is the
+// narrower one, if any.
+func intersectCIDRs(a, b []string) []string {
+	result := newStringSet()
+	for _, x := range a {
+		_, nx, err := net.ParseCIDR(x)
+		if err != nil {
+			continue
+		}
+		xOnes, _ := nx.Mask.Size()
+		for _, y := range b {
+			_, ny, err := net.ParseCIDR(y)
+			if err != nil {
+				continue
+			}
+			yOnes, _ := ny.Mask.Size()
+			switch {
+			case yOnes >= xOnes && nx.Contains(ny.IP):
+				result.add(ny.String())
+			case xOnes > yOnes && ny.Contains(nx.IP):
+				result.add(nx.String())
+			}
+		}
+	}
+	return result.list()
+}
+
+// capDuration limits d to max, treating a zero d as unlimited. A zero max
+// leaves d unchanged.
+func capDuration(d, max time.Duration) time.Duration {
+	if max > 0 && (d == 0 || d > max) {
+		return max
+	}
+	return d
+}
+
+// minDuration returns the shortest of the non-zero durations.
+func minDuration(a, b time.Duration) time.Duration {
+	if a == 0 || (b > 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// sanitizeTTL checks the TTLs against the system max lease TTL and caps ttl
+// to maxTTL, as the framework used to.
+func (b *backend) sanitizeTTL(ttl, maxTTL time.Duration) (time.Duration, time.Duration, error) {
+	sysMaxTTL := b.System().MaxLeaseTTL()
+	if ttl > sysMaxTTL {
+		return 0, 0, fmt.Errorf("\"ttl\" value must be less than allowed max lease TTL value '%s'", sysMaxTTL)
+	}
+	if maxTTL > sysMaxTTL {
+		return 0, 0, fmt.Errorf("\"max_ttl\" value must be less than allowed max lease TTL value '%s'", sysMaxTTL)
+	}
+	if ttl > maxTTL && maxTTL != 0 {
+		ttl = maxTTL
+	}
+	return ttl, maxTTL, nil
+}
@@ -0,0 +1,196 @@
+package chefclient
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	log "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestIntersectCIDRs(t *testing.T) {
+	cases := []struct {
+		name string
+		a, b []string
+		want []string
+	}{
+		{"same block", []string{"10.0.0.0/8"}, []string{"10.0.0.0/8"}, []string{"10.0.0.0/8"}},
+		{"nested in a", []string{"10.0.0.0/8"}, []string{"10.1.0.0/16"}, []string{"10.1.0.0/16"}},
+		{"nested in b", []string{"10.1.2.0/24"}, []string{"10.0.0.0/8"}, []string{"10.1.2.0/24"}},
+		{"single address", []string{"10.0.0.0/8"}, []string{"10.1.2.3/32"}, []string{"10.1.2.3/32"}},
+		{"host bits", []string{"10.1.2.3/8"}, []string{"10.1.0.0/16"}, []string{"10.1.0.0/16"}},
+		{"disjoint", []string{"10.0.0.0/8"}, []string{"192.168.0.0/16"}, []string{}},
+		{"adjacent", []string{"10.0.0.0/24"}, []string{"10.0.1.0/24"}, []string{}},
+		{"some overlap", []string{"10.0.0.0/8", "172.16.0.0/12"}, []string{"10.1.0.0/16", "192.168.0.0/16"}, []string{"10.1.0.0/16"}},
+		{"several overlaps", []string{"10.0.0.0/8"}, []string{"10.2.0.0/16", "10.1.0.0/16"}, []string{"10.2.0.0/16", "10.1.0.0/16"}},
+		{"duplicates", []string{"10.0.0.0/8", "10.0.0.0/16"}, []string{"10.0.0.0/16"}, []string{"10.0.0.0/16"}},
+		{"ipv6", []string{"2001:db8::/32"}, []string{"2001:db8:1::/48"}, []string{"2001:db8:1::/48"}},
+		{"ipv4 and ipv6", []string{"10.0.0.0/8"}, []string{"2001:db8::/32"}, []string{}},
+		{"invalid", []string{"10.0.0.0/8", "bad"}, []string{"bad", "10.1.0.0/16"}, []string{"10.1.0.0/16"}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := intersectCIDRs(tc.a, tc.b); !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestRestrict(t *testing.T) {
+	cases := []struct {
+		name string
+		s, o tokenSettings
+		want tokenSettings
+		err  bool
+	}{
+		{
+			name: "nothing set",
+		},
+		{
+			name: "shortest durations",
+			s:    tokenSettings{TTL: time.Hour, MaxTTL: 2 * time.Hour, Period: time.Hour, ExplicitMaxTTL: 10 * time.Hour},
+			o:    tokenSettings{TTL: 2 * time.Hour, MaxTTL: time.Hour, Period: 2 * time.Hour, ExplicitMaxTTL: 5 * time.Hour},
+			want: tokenSettings{TTL: time.Hour, MaxTTL: time.Hour, Period: time.Hour, ExplicitMaxTTL: 5 * time.Hour},
+		},
+		{
+			name: "zero durations are unlimited",
+			s:    tokenSettings{TTL: time.Hour},
+			o:    tokenSettings{MaxTTL: 2 * time.Hour},
+			want: tokenSettings{TTL: time.Hour, MaxTTL: 2 * time.Hour},
+		},
+		{
+			name: "fewest uses",
+			s:    tokenSettings{NumUses: 5},
+			o:    tokenSettings{NumUses: 3},
+			want: tokenSettings{NumUses: 3},
+		},
+		{
+			name: "zero uses are unlimited",
+			s:    tokenSettings{NumUses: 5},
+			o:    tokenSettings{},
+			want: tokenSettings{NumUses: 5},
+		},
+		{
+			name: "nested CIDRs",
+			s:    tokenSettings{BoundCIDRs: []string{"10.0.0.0/8"}},
+			o:    tokenSettings{BoundCIDRs: []string{"10.1.0.0/16"}},
+			want: tokenSettings{BoundCIDRs: []string{"10.1.0.0/16"}},
+		},
+		{
+			name: "CIDRs of one side",
+			s:    tokenSettings{},
+			o:    tokenSettings{BoundCIDRs: []string{"10.1.0.0/16"}},
+			want: tokenSettings{BoundCIDRs: []string{"10.1.0.0/16"}},
+		},
+		{
+			name: "disjoint CIDRs",
+			s:    tokenSettings{BoundCIDRs: []string{"10.0.0.0/8"}},
+			o:    tokenSettings{BoundCIDRs: []string{"192.168.0.0/16"}},
+			err:  true,
+		},
+		{
+			name: "batch wins over service",
+			s:    tokenSettings{TokenType: tokenTypeBatch},
+			o:    tokenSettings{TokenType: tokenTypeService},
+			want: tokenSettings{TokenType: tokenTypeBatch},
+		},
+		{
+			name: "service over default",
+			s:    tokenSettings{},
+			o:    tokenSettings{TokenType: tokenTypeService},
+			want: tokenSettings{TokenType: tokenTypeService},
+		},
+		{
+			name: "no default policy from either",
+			s:    tokenSettings{},
+			o:    tokenSettings{NoDefaultPolicy: true},
+			want: tokenSettings{NoDefaultPolicy: true},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := tc.s
+			err := s.restrict(&tc.o)
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(s, tc.want) {
+				t.Fatalf("expected %+v, got %+v", tc.want, s)
+			}
+		})
+	}
+}
+
+func TestCapDuration(t *testing.T) {
+	cases := []struct {
+		d, max, want time.Duration
+	}{
+		{time.Hour, 2 * time.Hour, time.Hour},
+		{2 * time.Hour, time.Hour, time.Hour},
+		{time.Hour, time.Hour, time.Hour},
+		{0, time.Hour, time.Hour},
+		{time.Hour, 0, time.Hour},
+		{0, 0, 0},
+	}
+
+	for _, tc := range cases {
+		if got := capDuration(tc.d, tc.max); got != tc.want {
+			t.Errorf("capDuration(%s, %s): expected %s, got %s", tc.d, tc.max, tc.want, got)
+		}
+	}
+}
+
+func TestSanitizeTTL(t *testing.T) {
+	ctx := context.Background()
+	config := &logical.BackendConfig{
+		Logger: log.NewNullLogger(),
+		System: &logical.StaticSystemView{MaxLeaseTTLVal: 24 * time.Hour},
+	}
+	b := Backend(config)
+	if err := b.Setup(ctx, config); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name             string
+		ttl, maxTTL      time.Duration
+		wantTTL, wantMax time.Duration
+		err              bool
+	}{
+		{"within limits", time.Hour, 2 * time.Hour, time.Hour, 2 * time.Hour, false},
+		{"ttl clamped to max_ttl", 3 * time.Hour, 2 * time.Hour, 2 * time.Hour, 2 * time.Hour, false},
+		{"no max_ttl", 3 * time.Hour, 0, 3 * time.Hour, 0, false},
+		{"at the system max", 24 * time.Hour, 24 * time.Hour, 24 * time.Hour, 24 * time.Hour, false},
+		{"ttl over the system max", 25 * time.Hour, 0, 0, 0, true},
+		{"max_ttl over the system max", time.Hour, 25 * time.Hour, 0, 0, true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ttl, maxTTL, err := b.sanitizeTTL(tc.ttl, tc.maxTTL)
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ttl != tc.wantTTL || maxTTL != tc.wantMax {
+				t.Fatalf("expected %s, %s, got %s, %s", tc.wantTTL, tc.wantMax, ttl, maxTTL)
+			}
+		})
+	}
+}